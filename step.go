@@ -2,273 +2,3353 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/user"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// -----------------------
+// --- models
+// -----------------------
+
+// ConfigsModel ...
+type ConfigsModel struct {
+	RepositoryURL         string
+	UpstreamRepositoryURL string
+	CloneIntoDir          string
+	Commit                string
+	Tag                   string
+	Branch                string
+	// the remote branch checked out as Branch, set from the branch input's local:remote form
+	RemoteBranch  string
+	PullRequestID string
+	// merges BaseBranch into the pull request's head locally, if the merge ref is missing
+	MergeLocally bool
+	BaseBranch   string
+	// pins the pull request's build to this commit, as the merge ref moves with the base branch
+	PullRequestHeadCommit string
+
+	StrictCheckoutSelection bool
+	SingleBranch            bool
+	CheckoutDefaultBranch   bool
+	RequireCheckout         bool
+	PreflightCheck          bool
+	ForceCheckout           bool
+	FetchCommitViaBranch    bool
+	CleanBeforeCheckout     string
+	ResetToRef              bool
+	VerifyCommitSignature   bool
+	VerifyIntegrity         bool
+	RecoverFromCorruption   bool
+	GPGPublicKeys           string
+	CloneFilter             string
+	CloneDepth              string
+	ShallowSince            string
+	AdditionalFetchRef      string
+	CustomFetchRefspec      string
+	CustomCheckoutRef       string
+	ShowProgress            bool
+	NoColor                 bool
+	EnableProtocolV2        bool
+	FetchPrune              bool
+	FetchPruneTags          bool
+	NoTags                  bool
+	SparseCheckoutPaths     []string
+	SubmoduleRecursive      bool
+	SubmodulePaths          []string
+	SubmoduleIgnorePaths    []string
+	// 0 means git's default
+	SubmoduleJobs       int
+	SubmoduleSkipInit   bool
+	PostCheckoutCommand string
+	CommitLogFormat     string
+	CommitMessageFile   string
+	ExportTarballPath   string
+	ChangedFilesAgainst string
+	ComputeTreeHash     bool
+	RemoveGitDir        bool
+	Bare                bool
+	SeparateGitDir      string
+	ForceCleanDir       bool
+	ExistingGitDir      string
+	SkipHooks           bool
+	AutoCRLF            string
+	OutputFormat        string
+	ExportOutputs       bool
+	OutputFile          string
+	OutputPrefix        string
+	AllowedRoot         string
+	AllowedHosts        []string
+
+	AuthSSHPrivateKey string
+	AuthSSHPassphrase string
+	AuthUser          string
+	AuthPassword      string
+	SSHDir            string
+	UseTempSSHDir     bool
+	// leaves GIT_ASKPASS alone, so a configured credential helper can answer
+	DisableAskpassOverride bool
+	AllowTerminalPrompt    bool
+
+	// pushed to after the clone, with its own https credentials if provided
+	MirrorToURL        string
+	MirrorAuthUser     string
+	MirrorAuthPassword string
+
+	// host - private key pairs
+	AdditionalSSHPrivateKeys []KeyValueModel
+	SSHOptions               []string
+	// [user@]host[:port] of the jump host
+	SSHProxyJump string
+	// overrides the port of the ssh urls
+	SSHPort string
+
+	GitConfigs   []KeyValueModel
+	GitUserName  string
+	GitUserEmail string
+	GitBinary    string
+
+	RetryCount    int
+	RetryWaitTime time.Duration
+	// 0 means no limit
+	MaxFetchBytes int
+	// none or deepen
+	ResumeStrategy string
+	// 0 means the full history is fetched if the shallow commit checkout fails
+	MaxDeepen int
+	// 0 means the tags are fetched by the main fetch
+	TagsOnlyDepth int
+}
+
+// FetchParamsModel ...
+type FetchParamsModel struct {
+	// origin if not set
+	Remote        string
+	CustomRefspec string
+	PullRequestID string
+	// merge (default) or head
+	PullRequestRef string
+	CheckoutParam  string
+	SingleBranch   string
+	CommitHash     string
+	Filter         string
+	Depth          string
+	ShallowSince   string
+	ShowProgress   bool
+	Prune          bool
+	PruneTags      bool
+	// fetches the history missing from a shallow fetch
+	Unshallow bool
+	// fetches this many more commits of a shallow history
+	Deepen int
+	// the refspecs fetched from the remote, if CustomRefspec is not set
+	Refspecs []string
+	NoTags   bool
+	// fetches every tag, and updates the local ones moved on the remote
+	// (the auto-followed tags are only fetched if they don't exist locally)
+	UpdateTags bool
+	// the fetch is killed if the clone dir grows more than this, 0 means no limit
+	MaxBytes int
+}
+
+// fetchBudgetExceededError is returned if the fetch is killed because of max_fetch_bytes,
+// it is neither retried nor falls back to an other fetch
+type fetchBudgetExceededError struct {
+	maxBytes int
+}
+
+func (err fetchBudgetExceededError) Error() string {
+	return fmt.Sprintf("fetch exceeded max_fetch_bytes (%d bytes) and was aborted", err.maxBytes)
+}
+
+func isFetchBudgetExceeded(err error) bool {
+	_, ok := err.(fetchBudgetExceededError)
+	return ok
+}
+
+// isMissingRemoteRefError reports whether the fetch failed as the remote has no such ref (e.g. no merge ref of a pull request)
+func isMissingRemoteRefError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "couldn't find remote ref")
+}
+
+// corruptRepositoryError is returned if the checkout or the integrity verification finds a corrupt object,
+// which is not fixed by fetching again, only by cloning from scratch (recover_from_corruption)
+type corruptRepositoryError struct {
+	err error
+}
+
+func (err corruptRepositoryError) Error() string {
+	return err.err.Error()
+}
+
+func isCorruptRepository(err error) bool {
+	_, ok := err.(corruptRepositoryError)
+	return ok
+}
+
+// the messages git reports reading a corrupt or missing object with
+var corruptObjectMessages = []string{
+	"is corrupt",
+	"bad object",
+	"object file",
+	"inflate:",
+	"unable to unpack",
+	"missing blob",
+	"missing tree",
+	"missing commit",
+	"broken link",
+}
+
+func isCorruptObjectError(err error) bool {
+	for _, message := range corruptObjectMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthMethod ...
+type AuthMethod int
+
+const (
+	// AuthMethodNone ...
+	AuthMethodNone AuthMethod = iota
+	// AuthMethodSSHKey ...
+	AuthMethodSSHKey
+	// AuthMethodHTTPS ...
+	AuthMethodHTTPS
+)
+
+// GitFeatureModel describes an option which requires a minimum git version
+type GitFeatureModel struct {
+	Name         string
+	MinimumMajor int
+	MinimumMinor int
+}
+
+// KeyValueModel ...
+type KeyValueModel struct {
+	Key   string
+	Value string
+}
+
+// CloneResultModel is printed to the stdout if output_format is json.
+// It must not contain the repository URL or any other input which could hold secrets.
+type CloneResultModel struct {
+	CommitHash           string  `json:"commit_hash"`
+	CommitMessageSubject string  `json:"commit_message_subject"`
+	CommitAuthorName     string  `json:"commit_author_name"`
+	CommitAuthorEmail    string  `json:"commit_author_email"`
+	Commit               string  `json:"commit"`
+	Tag                  string  `json:"tag"`
+	Branch               string  `json:"branch"`
+	PullRequestID        string  `json:"pull_request_id"`
+	CheckoutParam        string  `json:"checkout_param"`
+	CloneDurationSeconds float64 `json:"clone_duration_seconds"`
+	// the phases which were not run are omitted
+	FetchDurationSeconds     *float64 `json:"fetch_duration_seconds,omitempty"`
+	CheckoutDurationSeconds  *float64 `json:"checkout_duration_seconds,omitempty"`
+	SubmoduleDurationSeconds *float64 `json:"submodule_duration_seconds,omitempty"`
+	CloneIntoDir             string   `json:"clone_into_dir"`
+}
+
+// Leading / trailing whitespace (e.g. a newline pasted with the value) is trimmed,
+// internal spaces are kept as paths can legitimately contain them.
+func getInput(key string) string {
+	return strings.TrimSpace(os.Getenv(key))
+}
+
+func getListInput(key string) []string {
+	items := []string{}
+	for _, item := range strings.Split(os.Getenv(key), "\n") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getCommaSeparatedListInput(key string) []string {
+	items := []string{}
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getNonNegativeIntInput returns defaultValue if the input is not provided
+func getNonNegativeIntInput(key string, defaultValue int) (int, error) {
+	value := getInput(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("Invalid %s: %s (should be a non-negative integer)", key, value)
+	}
+	return number, nil
+}
+
+// parseKeyValueList parses key=value lines, splitting each line on the first =
+func parseKeyValueList(lines []string) ([]KeyValueModel, error) {
+	pairs := []KeyValueModel{}
+	for _, line := range lines {
+		keyValue := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(keyValue[0])
+		if len(keyValue) != 2 || key == "" {
+			return nil, fmt.Errorf("line (%s) is not in key=value format", line)
+		}
+		pairs = append(pairs, KeyValueModel{Key: key, Value: keyValue[1]})
+	}
+	return pairs, nil
+}
+
+func createConfigsModelFromEnvs() ConfigsModel {
+	return ConfigsModel{
+		RepositoryURL:         getInput("repository_url"),
+		UpstreamRepositoryURL: getInput("upstream_repository_url"),
+		CloneIntoDir:          getInput("clone_into_dir"),
+		Commit:                getInput("commit"),
+		Tag:                   getInput("tag"),
+		Branch:                getInput("branch"),
+		PullRequestID:         getInput("pull_request_id"),
+		MergeLocally:          getInput("merge_locally") == "true",
+		BaseBranch:            getInput("base_branch"),
+		PullRequestHeadCommit: getInput("pull_request_head_commit"),
+
+		StrictCheckoutSelection: getInput("strict_checkout_selection") == "true",
+		SingleBranch:            getInput("single_branch") == "true",
+		CheckoutDefaultBranch:   getInput("checkout_default_branch") == "true",
+		RequireCheckout:         getInput("require_checkout") == "true",
+		PreflightCheck:          getInput("preflight_check") == "true",
+		ForceCheckout:           getInput("force_checkout") == "true",
+		FetchCommitViaBranch:    getInput("fetch_commit_via_branch") == "true",
+		CleanBeforeCheckout:     getInput("clean_before_checkout"),
+		ResetToRef:              getInput("reset_to_ref") == "true",
+		VerifyCommitSignature:   getInput("verify_commit_signature") == "true",
+		VerifyIntegrity:         getInput("verify_integrity") == "true",
+		RecoverFromCorruption:   getInput("recover_from_corruption") == "true",
+		GPGPublicKeys:           os.Getenv("gpg_public_keys"),
+		CloneFilter:             getInput("clone_filter"),
+		CloneDepth:              getInput("clone_depth"),
+		ShallowSince:            getInput("shallow_since"),
+		AdditionalFetchRef:      getInput("additional_fetch_ref"),
+		CustomFetchRefspec:      getInput("custom_fetch_refspec"),
+		CustomCheckoutRef:       getInput("custom_checkout_ref"),
+		ShowProgress:            getInput("show_progress") != "false",
+		NoColor:                 getInput("no_color") == "true",
+		ResumeStrategy:          getInput("resume_strategy"),
+		EnableProtocolV2:        getInput("enable_protocol_v2") != "false",
+		FetchPrune:              getInput("fetch_prune") == "true",
+		FetchPruneTags:          getInput("fetch_prune_tags") == "true",
+		NoTags:                  getInput("no_tags") == "true",
+		SparseCheckoutPaths:     getListInput("sparse_checkout_paths"),
+		SubmoduleRecursive:      getInput("submodule_recursive") != "false",
+		SubmodulePaths:          getListInput("submodule_paths"),
+		SubmoduleIgnorePaths:    getListInput("submodule_ignore_paths"),
+		SubmoduleSkipInit:       getInput("submodule_update_only_initialized") == "true",
+		PostCheckoutCommand:     os.Getenv("post_checkout_command"),
+		CommitLogFormat:         os.Getenv("commit_log_format"),
+		CommitMessageFile:       getInput("commit_message_file"),
+		ExportTarballPath:       getInput("export_tarball_path"),
+		ChangedFilesAgainst:     getInput("changed_files_against"),
+		ComputeTreeHash:         getInput("compute_tree_hash") == "true",
+		RemoveGitDir:            getInput("remove_git_dir") == "true",
+		Bare:                    getInput("bare") == "true",
+		SeparateGitDir:          getInput("separate_git_dir"),
+		ForceCleanDir:           getInput("force_clean_dir") == "true",
+		ExistingGitDir:          getInput("existing_git_dir_strategy"),
+		SkipHooks:               getInput("skip_hooks") == "true",
+		AutoCRLF:                getInput("autocrlf"),
+		ExportOutputs:           getInput("export_outputs") != "false",
+		OutputFile:              getInput("output_file"),
+		OutputPrefix:            getInput("output_prefix"),
+		OutputFormat:            getInput("output_format"),
+		AllowedRoot:             getInput("allowed_root"),
+		AllowedHosts:            getCommaSeparatedListInput("allowed_hosts"),
+
+		AuthSSHPrivateKey:      os.Getenv("auth_ssh_private_key"),
+		AuthSSHPassphrase:      os.Getenv("auth_ssh_passphrase"),
+		AuthUser:               getInput("auth_user"),
+		AuthPassword:           os.Getenv("auth_password"),
+		DisableAskpassOverride: getInput("disable_askpass_override") == "true",
+		AllowTerminalPrompt:    getInput("allow_terminal_prompt") == "true",
+		MirrorToURL:            getInput("mirror_to_url"),
+		MirrorAuthUser:         getInput("mirror_auth_user"),
+		MirrorAuthPassword:     os.Getenv("mirror_auth_password"),
+		SSHDir:                 getInput("ssh_dir"),
+		UseTempSSHDir:          getInput("use_temp_ssh_dir") == "true",
+		SSHOptions:             strings.Fields(os.Getenv("ssh_options")),
+		SSHProxyJump:           getInput("ssh_proxy_jump"),
+		SSHPort:                getInput("ssh_port"),
+
+		GitUserName:  getInput("git_user_name"),
+		GitUserEmail: getInput("git_user_email"),
+		GitBinary:    getInput("git_binary"),
+	}
+}
+
 // -----------------------
 // --- functions
 // -----------------------
 
-func validateRequiredInput(key string) (string, error) {
-	value := os.Getenv(key)
-	if value == "" {
-		return "", fmt.Errorf("[!] Missing required input: %s", key)
-	}
-	return value, nil
-}
+func validateRequiredInput(key, value string) error {
+	if value == "" {
+		return fmt.Errorf("[!] Missing required input: %s", key)
+	}
+	return nil
+}
+
+// validatePathInsideRoot fails if pth (after resolving the .. segments) is outside of root
+func validatePathInsideRoot(pth, root string) error {
+	absPth, err := filepath.Abs(pth)
+	if err != nil {
+		return err
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	if absPth != absRoot && !strings.HasPrefix(absPth, absRoot+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of the allowed root (%s)", absPth, absRoot)
+	}
+	return nil
+}
+
+// isISODate reports whether the value is an ISO 8601 date, with an optional time
+func isISODate(value string) bool {
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05Z07:00", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBranchMapping splits the branch input's local:remote form,
+// a plain branch name is returned as both the local and the remote branch
+func parseBranchMapping(branch string) (string, string, error) {
+	split := strings.SplitN(branch, ":", 2)
+	if len(split) == 1 {
+		return branch, branch, nil
+	}
+	if split[0] == "" || split[1] == "" {
+		return "", "", fmt.Errorf("[!] Invalid branch mapping: %s (expected form: local:remote)", branch)
+	}
+	return split[0], split[1], nil
+}
+
+// validateFetchOptions fails if a fetch related input is invalid, or can't be used with an other one
+func validateFetchOptions(configs ConfigsModel) error {
+	if configs.CloneDepth != "" {
+		if depth, err := strconv.Atoi(configs.CloneDepth); err != nil || depth < 1 {
+			return fmt.Errorf("Invalid clone_depth: %s (should be a positive integer)", configs.CloneDepth)
+		}
+	}
+
+	if configs.ShallowSince != "" {
+		if configs.CloneDepth != "" {
+			return errors.New("shallow_since and clone_depth are mutually exclusive")
+		}
+		if !isISODate(configs.ShallowSince) {
+			return fmt.Errorf("Invalid shallow_since: %s (should be an ISO 8601 date, e.g. 2020-01-31 or 2020-01-31T12:00:00Z)", configs.ShallowSince)
+		}
+	}
+
+	// deepening starts from clone_depth, a history cut by date can't be deepened by commits
+	if configs.MaxDeepen > 0 && configs.CloneDepth == "" {
+		return errors.New("max_deepen can only be used with clone_depth")
+	}
+
+	if (configs.CustomFetchRefspec == "") != (configs.CustomCheckoutRef == "") {
+		return errors.New("custom_fetch_refspec and custom_checkout_ref have to be provided together")
+	}
+
+	if configs.ResumeStrategy != "" && configs.ResumeStrategy != "none" && configs.ResumeStrategy != "deepen" {
+		return fmt.Errorf("Invalid resume_strategy: %s (valid options: none, deepen)", configs.ResumeStrategy)
+	}
+	// the incremental fetch is for the full history, a shallow fetch is already limited
+	if configs.ResumeStrategy == "deepen" && (configs.CloneDepth != "" || configs.ShallowSince != "") {
+		return errors.New("resume_strategy (deepen) can't be used with clone_depth or shallow_since")
+	}
+
+	if configs.NoTags {
+		if configs.TagsOnlyDepth > 0 {
+			return errors.New("no_tags and tags_only_depth are mutually exclusive")
+		}
+		if configs.Tag != "" {
+			return fmt.Errorf("no_tags can't be used with a tag (%s) checkout", configs.Tag)
+		}
+	}
+
+	return nil
+}
+
+func validateCheckoutSelectors(configs ConfigsModel, gitCheckoutParam string) error {
+	providedSelectors := []string{}
+	if configs.PullRequestID != "" {
+		providedSelectors = append(providedSelectors, "pull_request_id")
+	}
+	if configs.Commit != "" {
+		providedSelectors = append(providedSelectors, "commit")
+	}
+	if configs.Tag != "" {
+		providedSelectors = append(providedSelectors, "tag")
+	}
+	// with fetch_commit_via_branch the branch only scopes the commit's fetch,
+	// and a relative commit (e.g. HEAD~2) is resolved from the branch, it's not an other checkout parameter
+	if configs.Branch != "" && (configs.Commit == "" || (!configs.FetchCommitViaBranch && !isRelativeRevision(configs.Commit))) {
+		providedSelectors = append(providedSelectors, "branch")
+	}
+
+	if len(providedSelectors) < 2 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("Multiple checkout parameters provided (%s), resolved checkout parameter: %s", strings.Join(providedSelectors, ", "), gitCheckoutParam)
+	if configs.StrictCheckoutSelection {
+		return fmt.Errorf("[!] %s", msg)
+	}
+	fmt.Printf(" [!] %s\n", msg)
+	return nil
+}
+
+var (
+	// set from the export_outputs input, the outputs are neither exported nor printed if false
+	isExportOutputs = true
+
+	checkEnvmanOnce   sync.Once
+	isEnvmanAvailable bool
+
+	// set from the output_file input, the outputs are also written into this file if not empty
+	outputFilePath string
+	// set from the output_prefix input, prepended to every output's key
+	outputPrefix string
+)
+
+// isEnvVarName reports whether the name can be used as (the start of) an environment variable's name
+func isEnvVarName(name string) bool {
+	for i, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return name != ""
+}
+
+// dotenvQuote wraps the value in double quotes, escaping the characters
+// which would be interpreted by a dotenv parser (e.g. the new lines of the commit message body)
+func dotenvQuote(value string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		`$`, `\$`,
+		"`", "\\`",
+		"\n", `\n`,
+		"\r", `\r`,
+	)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// appendOutputToFile appends the output to outputFilePath as a dotenv-style KEY="value" line
+func appendOutputToFile(key, value string) error {
+	file, err := os.OpenFile(outputFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%s=%s\n", key, dotenvQuote(value)); err != nil {
+		if closeErr := file.Close(); closeErr != nil {
+			fmt.Printf(" [!] Failed to close file (%s), err: %s\n", outputFilePath, closeErr)
+		}
+		return err
+	}
+	return file.Close()
+}
+
+// exportOutput exports the output with envmanAdd, and only prints the error if it fails,
+// so a failed export doesn't fail the step
+func exportOutput(key, value string) {
+	if err := envmanAdd(key, value); err != nil {
+		fmt.Printf("Failed to export output: (%s), err: %s\n", key, err)
+	}
+}
+
+// envmanAdd exports the output with envman,
+// or prints it in KEY=VALUE form if envman is not available (e.g. running the step outside of the Bitrise CLI)
+func envmanAdd(key, value string) error {
+	if !isExportOutputs {
+		return nil
+	}
+	key = outputPrefix + key
+
+	if outputFilePath != "" {
+		if err := appendOutputToFile(key, value); err != nil {
+			return fmt.Errorf("failed to write the output into %s, err: %s", outputFilePath, err)
+		}
+	}
+
+	checkEnvmanOnce.Do(func() {
+		if _, err := exec.LookPath("envman"); err != nil {
+			fmt.Println(" [!] envman not found in PATH, printing the outputs instead of exporting them")
+			return
+		}
+		isEnvmanAvailable = true
+	})
+	if !isEnvmanAvailable {
+		fmt.Printf("%s=%s\n", key, value)
+		return nil
+	}
+
+	args := []string{"add", "--key", key}
+
+	cmd := exec.Command("envman", args...)
+	cmd.Stdin = strings.NewReader(value)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// gitBinary is the git executable used for every git command, set from the git_binary input
+var gitBinary = "git"
+
+// gitGlobalArgs are passed to every git command before the subcommand, e.g. -c color.ui=never for no_color
+var gitGlobalArgs []string
+
+// getGitGlobalArgs returns the global args of the enabled options
+func getGitGlobalArgs(configs ConfigsModel) []string {
+	args := []string{}
+	// keeps the logs plain text, even if color.ui=always is set globally
+	if configs.NoColor {
+		args = append(args, "-c", "color.ui=never")
+	}
+	return args
+}
+
+func withGitGlobalArgs(args []string) []string {
+	return append(append([]string{}, gitGlobalArgs...), args...)
+}
+
+// validateExecutable checks that the path points to an executable file
+func validateExecutable(pth string) error {
+	fileInfo, exist, err := genericIsPathExists(pth)
+	if err != nil {
+		return err
+	} else if !exist {
+		return fmt.Errorf("%s does not exist", pth)
+	}
+	if fileInfo.IsDir() || fileInfo.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", pth)
+	}
+	return nil
+}
+
+// runGitCommand streams the command's output to the console, and includes the captured stderr
+// in the returned error, so the actual git error message is part of the error chain.
+func runGitCommand(runner CommandRunner, dir string, args ...string) error {
+	return runGitCommandWithContext(context.Background(), runner, dir, nil, args...)
+}
+
+func runGitCommandWithContext(ctx context.Context, runner CommandRunner, dir string, env []string, args ...string) error {
+	errBuffer := bytes.Buffer{}
+
+	if err := runner.Run(ctx, dir, env, os.Stdout, io.MultiWriter(os.Stderr, &errBuffer), gitBinary, withGitGlobalArgs(args)...); err != nil {
+		return fmt.Errorf("git %s failed, err: %s, details: %s", args[0], err, strings.TrimSpace(errBuffer.String()))
+	}
+	return nil
+}
+
+// getExistingRepository describes the repository already present
+// in the clone destination (or the separate git dir), empty if there is none
+func getExistingRepository(configs ConfigsModel) (string, error) {
+	gitCheckPath := path.Join(configs.CloneIntoDir, ".git")
+	if exist, err := isPathExists(gitCheckPath); err != nil {
+		return "", fmt.Errorf("Failed to file path (%s), err: %s", gitCheckPath, err)
+	} else if exist {
+		return fmt.Sprintf(".git folder already exists in the destination dir (%s)", gitCheckPath), nil
+	}
+	if configs.SeparateGitDir != "" {
+		if exist, err := isPathExists(path.Join(configs.SeparateGitDir, "HEAD")); err != nil {
+			return "", fmt.Errorf("Failed to file path (%s), err: %s", configs.SeparateGitDir, err)
+		} else if exist {
+			return fmt.Sprintf("A git repository already exists in the separate git dir (%s)", configs.SeparateGitDir), nil
+		}
+	}
+	// a bare repository has its objects (and HEAD) at the top level
+	if configs.Bare {
+		gitCheckPath = path.Join(configs.CloneIntoDir, "HEAD")
+		if exist, err := isPathExists(gitCheckPath); err != nil {
+			return "", fmt.Errorf("Failed to file path (%s), err: %s", gitCheckPath, err)
+		} else if exist {
+			return fmt.Sprintf("A bare git repository already exists in the destination dir (%s)", configs.CloneIntoDir), nil
+		}
+	}
+	return "", nil
+}
+
+// with separateGitDir the repository is created there, and cloneIntoDir/.git is a file pointing to it
+func doGitInit(runner CommandRunner, cloneIntoDir string, isBare bool, separateGitDir string) error {
+	if isBare {
+		return runGitCommand(runner, cloneIntoDir, "init", "--bare")
+	}
+	if separateGitDir != "" {
+		return runGitCommand(runner, cloneIntoDir, "init", "--separate-git-dir="+separateGitDir)
+	}
+	return runGitCommand(runner, cloneIntoDir, "init")
+}
+
+// getGitDir returns the repository's git dir, which is not cloneIntoDir/.git with separate_git_dir
+func getGitDir(runner CommandRunner, cloneIntoDir string) (string, error) {
+	out, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "--git-dir")
+	if err != nil {
+		return "", err
+	}
+	gitDir := strings.TrimSpace(out)
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(cloneIntoDir, gitDir)
+	}
+	return gitDir, nil
+}
+
+// doGitAddRemote adds the remote, or updates its url if it already exists (in a reused repository)
+func doGitAddRemote(runner CommandRunner, cloneIntoDir, remoteName, repositoryURL string) error {
+	if _, err := getGitOutput(runner, cloneIntoDir, "remote", "get-url", remoteName); err == nil {
+		return runGitCommand(runner, cloneIntoDir, "remote", "set-url", remoteName, repositoryURL)
+	}
+	return runGitCommand(runner, cloneIntoDir, "remote", "add", remoteName, repositoryURL)
+}
+
+// The retry wait times are randomized by ±retryJitter, so the builds retrying
+// a downed server don't hit it at the same time on recovery.
+// The random source and the sleep can be replaced (and retryJitter set to 0) for deterministic runs.
+var (
+	retryJitter = 0.25
+	retryRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	retrySleep  = time.Sleep
+)
+
+func jitteredWaitTime(waitTime time.Duration) time.Duration {
+	if retryJitter == 0 {
+		return waitTime
+	}
+	factor := 1 - retryJitter + 2*retryJitter*retryRand.Float64()
+	return time.Duration(float64(waitTime) * factor)
+}
+
+// retryCommand calls command until it succeeds, at most retryCount + 1 times.
+// The wait time between the attempts is doubled after every failed attempt.
+// An exceeded fetch budget or a missing remote ref is not retried, those fail the same way again.
+func retryCommand(name string, retryCount int, waitTime time.Duration, command func() error) error {
+	err := command()
+	for attempt := 1; err != nil && !isFetchBudgetExceeded(err) && !isMissingRemoteRefError(err) && attempt <= retryCount; attempt++ {
+		jitteredWait := jitteredWaitTime(waitTime)
+		fmt.Printf(" [!] %s failed (attempt %d/%d), retrying in %s, err: %s\n", name, attempt, retryCount+1, jitteredWait, err)
+		retrySleep(jitteredWait)
+		waitTime *= 2
+
+		err = command()
+	}
+	return err
+}
+
+func doGitFetch(runner CommandRunner, cloneIntoDir string, params FetchParamsModel) error {
+	args := []string{"fetch"}
+	// stdout / stderr is not a terminal on CI, git only reports the progress if it's forced
+	if params.ShowProgress {
+		args = append(args, "--progress")
+	}
+	if params.Filter != "" {
+		args = append(args, "--filter="+params.Filter)
+	}
+	if params.Depth != "" {
+		args = append(args, "--depth="+params.Depth)
+	}
+	if params.ShallowSince != "" {
+		args = append(args, "--shallow-since="+params.ShallowSince)
+	}
+	if params.Unshallow {
+		args = append(args, "--unshallow")
+	}
+	if params.Deepen > 0 {
+		args = append(args, fmt.Sprintf("--deepen=%d", params.Deepen))
+	}
+	if params.NoTags {
+		args = append(args, "--no-tags")
+	}
+	if params.UpdateTags && !params.NoTags {
+		args = append(args, "--tags", "--force")
+	}
+	// removes the stale remote-tracking refs, --prune-tags only takes effect together with --prune
+	if params.Prune || params.PruneTags {
+		args = append(args, "--prune")
+	}
+	if params.PruneTags {
+		args = append(args, "--prune-tags")
+	}
+	remote := params.Remote
+	if remote == "" {
+		remote = "origin"
+	}
+	if params.CustomRefspec != "" {
+		args = append(args, remote, params.CustomRefspec)
+	} else if len(params.Refspecs) > 0 {
+		args = append(args, remote)
+		args = append(args, params.Refspecs...)
+		// e.g. a commit which is not a branch tip, next to the bare repository's branches
+		if params.CommitHash != "" {
+			args = append(args, params.CommitHash)
+		}
+	} else if params.PullRequestID != "" {
+		pullRequestRef := params.PullRequestRef
+		if pullRequestRef == "" {
+			pullRequestRef = "merge"
+		}
+		args = append(args, remote, "+pull/"+params.PullRequestID+"/"+pullRequestRef+":"+params.CheckoutParam)
+	} else if params.CommitHash != "" {
+		args = append(args, remote, params.CommitHash)
+	} else if params.SingleBranch != "" {
+		args = append(args, remote, "refs/heads/"+params.SingleBranch+":refs/remotes/"+remote+"/"+params.SingleBranch)
+	} else if params.Remote != "" {
+		args = append(args, params.Remote)
+	}
+
+	if params.MaxBytes == 0 {
+		return runGitCommand(runner, cloneIntoDir, args...)
+	}
+	// the objects are fetched into the git dir, which is outside of cloneIntoDir with separate_git_dir
+	gitDir, err := getGitDir(runner, cloneIntoDir)
+	if err != nil {
+		return err
+	}
+	return runGitCommandWithBudget(runner, cloneIntoDir, gitDir, params.MaxBytes, args...)
+}
+
+// runGitCommandWithBudget kills the command if budgetDir grows more than maxBytes while it runs
+func runGitCommandWithBudget(runner CommandRunner, dir, budgetDir string, maxBytes int, args ...string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// dirSize doesn't walk into a symlinked dir
+	if resolvedBudgetDir, err := filepath.EvalSymlinks(budgetDir); err == nil {
+		budgetDir = resolvedBudgetDir
+	}
+	initialSize := dirSize(budgetDir)
+	isExceeded := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				isExceeded <- false
+				return
+			case <-ticker.C:
+				if dirSize(budgetDir)-initialSize > int64(maxBytes) {
+					isExceeded <- true
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err := runGitCommandWithContext(ctx, runner, dir, nil, args...)
+	cancel()
+	// a fast command might finish between two checks
+	if <-isExceeded || dirSize(budgetDir)-initialSize > int64(maxBytes) {
+		return fetchBudgetExceededError{maxBytes: maxBytes}
+	}
+	return err
+}
+
+// doGitFetchWithFallbacks retries the fetch without the options the server might reject
+func doGitFetchWithFallbacks(runner CommandRunner, cloneIntoDir string, params FetchParamsModel) error {
+	err := doGitFetch(runner, cloneIntoDir, params)
+	if isFetchBudgetExceeded(err) {
+		return err
+	}
+
+	// servers without uploadpack.allowReachableSHA1InWant reject fetching a commit by its hash
+	if err != nil && params.CommitHash != "" {
+		fmt.Printf(" [!] Fetch of the commit (%s) failed, falling back to fetching all branches, err: %s\n", params.CommitHash, err)
+		params.CommitHash = ""
+		err = doGitFetch(runner, cloneIntoDir, params)
+	}
+
+	// servers without partial clone support reject the --filter
+	if err != nil && params.Filter != "" {
+		fmt.Printf(" [!] Fetch with filter (%s) failed, falling back to a normal fetch, err: %s\n", params.Filter, err)
+		params.Filter = ""
+		err = doGitFetch(runner, cloneIntoDir, params)
+	}
+	return err
+}
+
+func doGitCheckout(runner CommandRunner, cloneIntoDir, gitCheckoutParam string, isForce bool) error {
+	args := []string{"checkout"}
+	if isForce {
+		args = append(args, "-f")
+	}
+	args = append(args, gitCheckoutParam)
+
+	return runGitCommand(runner, cloneIntoDir, args...)
+}
+
+// doGitCheckoutBranch checks out the fetched remote branch by its full ref into a local tracking branch,
+// so it can't be confused with a tag of the same name
+// With isReset an already existing local branch is reset to the fetched tip (checkout -B), even if it diverged.
+func doGitCheckoutBranch(runner CommandRunner, cloneIntoDir, branch, remoteBranch string, isForce, isReset bool) error {
+	args := []string{"checkout"}
+	if isForce {
+		args = append(args, "-f")
+	}
+	createFlag := "-b"
+	if isReset {
+		createFlag = "-B"
+	}
+	args = append(args, createFlag, branch, "--track", "refs/remotes/origin/"+remoteBranch)
+
+	return runGitCommand(runner, cloneIntoDir, args...)
+}
+
+func isGitRefExists(runner CommandRunner, cloneIntoDir, ref string) bool {
+	_, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "--verify", "--quiet", ref)
+	return err == nil
+}
+
+// deepenUntilCheckout deepens the shallow history, doubling the deepening every time
+// (starting from clone_depth), and retries the checkout until it succeeds or max_deepen commits are fetched
+func deepenUntilCheckout(runner CommandRunner, configs ConfigsModel, checkout func() error, checkoutErr error, suggestion string) error {
+	step, err := strconv.Atoi(configs.CloneDepth)
+	if err != nil || step < 1 {
+		step = 1
+	}
+
+	deepened := 0
+	for deepened < configs.MaxDeepen {
+		if step > configs.MaxDeepen-deepened {
+			step = configs.MaxDeepen - deepened
+		}
+		fmt.Printf(" [!] Checkout of the commit (%s) failed, deepening the history by %d commits, err: %s\n", configs.Commit, step, checkoutErr)
+		deepenParams := FetchParamsModel{
+			Deepen:       step,
+			ShowProgress: configs.ShowProgress,
+		}
+		if err := doGitFetch(runner, configs.CloneIntoDir, deepenParams); err != nil {
+			return fmt.Errorf("deepening the history failed, err: %s, %s", err, suggestion)
+		}
+		deepened += step
+		step *= 2
+
+		if checkoutErr = checkout(); checkoutErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s, the commit is not reachable after deepening the history by max_deepen (%d) commits, %s", checkoutErr, configs.MaxDeepen, suggestion)
+}
+
+// getShallowCommits returns the boundary commits of a shallow history, or an empty string if the history is complete
+func getShallowCommits(runner CommandRunner, cloneIntoDir string) (string, error) {
+	gitDir, err := getGitDir(runner, cloneIntoDir)
+	if err != nil {
+		return "", err
+	}
+	shallowPth := path.Join(gitDir, "shallow")
+	if exist, err := isPathExists(shallowPth); err != nil || !exist {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(shallowPth)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// the first step of the incremental fetch (resume_strategy: deepen), doubled after every step
+const resumeDeepenStep = 100
+
+// doGitFetchIncrementally fetches the history in growing steps (--depth, then --deepen),
+// the objects of every finished step are kept, so a repeated attempt continues from the last finished step,
+// instead of downloading the whole history again.
+func doGitFetchIncrementally(runner CommandRunner, cloneIntoDir string, params FetchParamsModel) error {
+	shallowCommits, err := getShallowCommits(runner, cloneIntoDir)
+	if err != nil {
+		return err
+	}
+
+	step := resumeDeepenStep
+	if shallowCommits == "" && !isGitRefExists(runner, cloneIntoDir, "FETCH_HEAD") {
+		fmt.Printf("Fetching the last %d commits\n", step)
+		stepParams := params
+		stepParams.Depth = strconv.Itoa(step)
+		if err := doGitFetchWithFallbacks(runner, cloneIntoDir, stepParams); err != nil {
+			return err
+		}
+		if shallowCommits, err = getShallowCommits(runner, cloneIntoDir); err != nil {
+			return err
+		}
+	}
+
+	for shallowCommits != "" {
+		step *= 2
+		fmt.Printf("Deepening the history by %d commits\n", step)
+		stepParams := params
+		stepParams.Deepen = step
+		if err := doGitFetchWithFallbacks(runner, cloneIntoDir, stepParams); err != nil {
+			return err
+		}
+
+		previousShallowCommits := shallowCommits
+		if shallowCommits, err = getShallowCommits(runner, cloneIntoDir); err != nil {
+			return err
+		}
+		// the server did not send more history, the rest is fetched at once
+		if shallowCommits == previousShallowCommits {
+			unshallowParams := params
+			unshallowParams.Unshallow = true
+			return doGitFetchWithFallbacks(runner, cloneIntoDir, unshallowParams)
+		}
+	}
+
+	// the history is complete, only the refs (e.g. the tags) might be missing
+	return doGitFetchWithFallbacks(runner, cloneIntoDir, params)
+}
+
+// doGitFetchTags fetches the remote's tags with the given depth.
+// A shallow fetch marks the fetched commits as the history's boundary, even if their history is already fetched,
+// so the tags of the already fetched commits are fetched without depth, which only downloads the tag objects.
+func doGitFetchTags(runner CommandRunner, cloneIntoDir string, depth int, showProgress bool) error {
+	// output format: <hash><TAB>refs/tags/<name>, followed by <hash><TAB>refs/tags/<name>^{} for annotated tags
+	out, err := getGitOutput(runner, cloneIntoDir, "ls-remote", "--tags", "origin")
+	if err != nil {
+		return err
+	}
+
+	tagCommits := map[string]string{}
+	tagRefs := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if ref := strings.TrimSuffix(fields[1], "^{}"); ref != fields[1] {
+			tagCommits[ref] = fields[0]
+			continue
+		}
+		if _, ok := tagCommits[fields[1]]; !ok {
+			tagCommits[fields[1]] = fields[0]
+		}
+		tagRefs = append(tagRefs, fields[1])
+	}
+
+	fetchedRefspecs := []string{}
+	missingRefspecs := []string{}
+	for _, ref := range tagRefs {
+		refspec := "+" + ref + ":" + ref
+		if isGitRefExists(runner, cloneIntoDir, tagCommits[ref]+"^{commit}") {
+			fetchedRefspecs = append(fetchedRefspecs, refspec)
+		} else {
+			missingRefspecs = append(missingRefspecs, refspec)
+		}
+	}
+
+	if len(fetchedRefspecs) > 0 {
+		if err := doGitFetch(runner, cloneIntoDir, FetchParamsModel{Refspecs: fetchedRefspecs, NoTags: true, ShowProgress: showProgress}); err != nil {
+			return err
+		}
+	}
+	if len(missingRefspecs) > 0 {
+		if err := doGitFetch(runner, cloneIntoDir, FetchParamsModel{Refspecs: missingRefspecs, NoTags: true, Depth: strconv.Itoa(depth), ShowProgress: showProgress}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEmptyRepository reports whether the fetch brought nothing: no refs and no FETCH_HEAD,
+// which is the case for a repository without commits
+func isEmptyRepository(runner CommandRunner, cloneIntoDir string) bool {
+	out, err := getGitOutput(runner, cloneIntoDir, "for-each-ref", "--count=1")
+	if err != nil || strings.TrimSpace(out) != "" {
+		return false
+	}
+	return !isGitRefExists(runner, cloneIntoDir, "FETCH_HEAD")
+}
+
+// doGitLocalMerge merges the ref into HEAD,
+// on conflict the merge is aborted and the conflicting files are returned
+func doGitLocalMerge(runner CommandRunner, cloneIntoDir, ref string) ([]string, error) {
+	mergeErr := runGitCommand(runner, cloneIntoDir, "merge", "--no-ff", "--no-edit", ref)
+	if mergeErr == nil {
+		return nil, nil
+	}
+
+	out, err := getGitOutput(runner, cloneIntoDir, "diff", "-z", "--name-only", "--diff-filter=U")
+	if err != nil {
+		return nil, mergeErr
+	}
+	conflicts := splitNulTerminated(out)
+	if len(conflicts) == 0 {
+		// not a conflict, e.g. unrelated histories of a shallow fetch
+		return nil, mergeErr
+	}
+
+	if err := runGitCommand(runner, cloneIntoDir, "merge", "--abort"); err != nil {
+		fmt.Printf(" [!] Failed to abort the merge, err: %s\n", err)
+	}
+	return conflicts, mergeErr
+}
+
+func doGitConfig(runner CommandRunner, cloneIntoDir, key, value string) error {
+	return runGitCommand(runner, cloneIntoDir, "config", "--local", key, value)
+}
+
+func doGitSparseCheckout(runner CommandRunner, cloneIntoDir string, sparseCheckoutPaths []string) error {
+	if err := runGitCommand(runner, cloneIntoDir, "sparse-checkout", "init", "--cone"); err != nil {
+		fmt.Println(" [!] git sparse-checkout is not available, falling back to core.sparseCheckout")
+		return doGitLegacySparseCheckout(runner, cloneIntoDir, sparseCheckoutPaths)
+	}
+
+	args := append([]string{"sparse-checkout", "set"}, sparseCheckoutPaths...)
+	return runGitCommand(runner, cloneIntoDir, args...)
+}
+
+// fallback for git versions (< 2.25) without the sparse-checkout command
+func doGitLegacySparseCheckout(runner CommandRunner, cloneIntoDir string, sparseCheckoutPaths []string) error {
+	if err := runGitCommand(runner, cloneIntoDir, "config", "core.sparseCheckout", "true"); err != nil {
+		return err
+	}
+
+	patterns := ""
+	for _, sparsePath := range sparseCheckoutPaths {
+		patterns += "/" + strings.Trim(sparsePath, "/") + "/\n"
+	}
+
+	gitDir, err := getGitDir(runner, cloneIntoDir)
+	if err != nil {
+		return err
+	}
+	infoDir := path.Join(gitDir, "info")
+	if err := os.MkdirAll(infoDir, 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(infoDir, "sparse-checkout"), []byte(patterns), 0666)
+}
+
+// doGitClean removes the untracked files, so those can't fail the checkout.
+// clean keeps the ignored files, clean-xdff removes those too, with the nested repositories.
+func doGitClean(runner CommandRunner, cloneIntoDir, mode string) error {
+	if mode == "clean-xdff" {
+		return runGitCommand(runner, cloneIntoDir, "clean", "-xdff")
+	}
+	return runGitCommand(runner, cloneIntoDir, "clean", "-fd")
+}
+
+// without isInit only the already initialized submodules are updated
+func doGitSubmodelueUpdate(runner CommandRunner, cloneIntoDir string, isInit, isRecursive bool, jobs int, submodulePaths []string) error {
+	args := []string{"submodule", "update"}
+	if isInit {
+		args = append(args, "--init")
+	}
+	if isRecursive {
+		args = append(args, "--recursive")
+	}
+	if jobs > 0 {
+		args = append(args, "--jobs", strconv.Itoa(jobs))
+	}
+	if len(submodulePaths) > 0 {
+		args = append(args, "--")
+		args = append(args, submodulePaths...)
+	}
+
+	return runGitCommand(runner, cloneIntoDir, args...)
+}
+
+// doGitSubmoduleIgnore sets submodule.<name>.update to none for the submodules at the given paths,
+// so git submodule update skips those
+func doGitSubmoduleIgnore(runner CommandRunner, cloneIntoDir string, ignorePaths []string) error {
+	if exist, err := isPathExists(filepath.Join(cloneIntoDir, ".gitmodules")); err != nil {
+		return err
+	} else if !exist {
+		fmt.Println(" [!] The repository has no submodules, submodule_ignore_paths won't be used")
+		return nil
+	}
+
+	// output format: submodule.<name>.path <path>
+	out, err := getGitOutput(runner, cloneIntoDir, "config", "--file", ".gitmodules", "--get-regexp", `^submodule\..*\.path$`)
+	if err != nil {
+		return err
+	}
+	submoduleNames := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		keyPath := strings.SplitN(line, " ", 2)
+		if len(keyPath) != 2 {
+			continue
+		}
+		submoduleNames[keyPath[1]] = strings.TrimSuffix(strings.TrimPrefix(keyPath[0], "submodule."), ".path")
+	}
+
+	for _, ignorePath := range ignorePaths {
+		name, ok := submoduleNames[strings.TrimSuffix(ignorePath, "/")]
+		if !ok {
+			fmt.Printf(" [!] No submodule found at path (%s), it can't be ignored\n", ignorePath)
+			continue
+		}
+		fmt.Printf("Ignoring submodule: %s\n", ignorePath)
+		if err := doGitConfig(runner, cloneIntoDir, "submodule."+name+".update", "none"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSubmoduleStatus returns the output of git submodule status,
+// which changes if a submodule is initialized or its checked out commit changes
+func getSubmoduleStatus(runner CommandRunner, cloneIntoDir string, isRecursive bool) (string, error) {
+	args := []string{"submodule", "status"}
+	if isRecursive {
+		args = append(args, "--recursive")
+	}
+	return getGitOutput(runner, cloneIntoDir, args...)
+}
+
+// getSubmodules returns the initialized submodules in "path @ sha" format, based on git submodule status,
+// the sha is the submodule's checked out commit
+func getSubmodules(runner CommandRunner, cloneIntoDir string, isRecursive bool) ([]string, error) {
+	out, err := getSubmoduleStatus(runner, cloneIntoDir, isRecursive)
+	if err != nil {
+		return nil, err
+	}
+
+	// line format: [ +-U]<sha> <path> (<describe>)
+	// - is an uninitialized submodule (e.g. ignored by submodule_ignore_paths), U is a conflicting one without a checked out commit,
+	// + is checked out at a different commit than the one recorded in the repository
+	submodules := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 2 || line[0] == '-' || line[0] == 'U' {
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 {
+			continue
+		}
+		submodules = append(submodules, fields[1]+" @ "+fields[0])
+	}
+	return submodules, nil
+}
+
+func runPostCheckoutCommand(runner CommandRunner, cloneIntoDir, command string) (int, string, error) {
+	outBuffer := bytes.Buffer{}
+
+	err := runner.Run(context.Background(), cloneIntoDir, nil, io.MultiWriter(os.Stdout, &outBuffer), io.MultiWriter(os.Stderr, &outBuffer), "bash", "-c", command)
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), outBuffer.String(), err
+		}
+		return -1, outBuffer.String(), err
+	}
+	return 0, outBuffer.String(), nil
+}
+
+// parseDurationSeconds returns nil if the duration was not recorded
+func parseDurationSeconds(value string) *float64 {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil
+	}
+	return &seconds
+}
+
+func printCloneResultJSON(configs ConfigsModel, commitStats map[string]string, cloneDuration time.Duration) error {
+	result := CloneResultModel{
+		CommitHash:           strings.TrimSpace(commitStats["GIT_CLONE_COMMIT_HASH"]),
+		CommitMessageSubject: strings.TrimSpace(commitStats["GIT_CLONE_COMMIT_MESSAGE_SUBJECT"]),
+		CommitAuthorName:     strings.TrimSpace(commitStats["GIT_CLONE_COMMIT_AUTHOR_NAME"]),
+		CommitAuthorEmail:    strings.TrimSpace(commitStats["GIT_CLONE_COMMIT_AUTHOR_EMAIL"]),
+		Commit:               configs.Commit,
+		Tag:                  configs.Tag,
+		Branch:               configs.Branch,
+		PullRequestID:        configs.PullRequestID,
+		CheckoutParam:        commitStats["GIT_CLONE_CHECKOUT_REF"],
+		CloneDurationSeconds: cloneDuration.Seconds(),
+		CloneIntoDir:         configs.CloneIntoDir,
+
+		FetchDurationSeconds:     parseDurationSeconds(commitStats["GIT_CLONE_FETCH_DURATION_SECONDS"]),
+		CheckoutDurationSeconds:  parseDurationSeconds(commitStats["GIT_CLONE_CHECKOUT_DURATION_SECONDS"]),
+		SubmoduleDurationSeconds: parseDurationSeconds(commitStats["GIT_CLONE_SUBMODULE_DURATION_SECONDS"]),
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(resultBytes))
+	return nil
+}
+
+// homeDir returns $HOME, or the current user's home directory if $HOME is not set (e.g. in minimal containers)
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("HOME environment variable is not set, and failed to look up the current user, err: %s", err)
+	}
+	if currentUser.HomeDir == "" {
+		return "", errors.New("HOME environment variable is not set, and the current user has no home directory")
+	}
+	return currentUser.HomeDir, nil
+}
+
+// resolveSSHDir returns the directory for the ssh related files, ~/.ssh if sshDir is not provided.
+// The directory is created if it doesn't exist yet.
+func resolveSSHDir(sshDir string) (string, error) {
+	if sshDir == "" {
+		home, err := homeDir()
+		if err != nil {
+			return "", fmt.Errorf("%s, provide the ssh_dir input", err)
+		}
+		sshDir = path.Join(home, ".ssh")
+	}
+
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		return "", fmt.Errorf("Failed to create ssh dir (%s), provide a writable directory as the ssh_dir input, err: %s", sshDir, err)
+	}
+
+	testFile, err := ioutil.TempFile(sshDir, ".bitrise_write_test")
+	if err != nil {
+		return "", fmt.Errorf("ssh dir (%s) is not writable, provide a writable directory as the ssh_dir input, err: %s", sshDir, err)
+	}
+	if err := testFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Remove(testFile.Name()); err != nil {
+		return "", err
+	}
+	return sshDir, nil
+}
+
+// isPrivateKeyFormat reports whether the content looks like a PEM / OpenSSH private key,
+// it does not parse the key, only catches the malformed / truncated ones early
+func isPrivateKeyFormat(privateKey string) bool {
+	privateKey = strings.TrimSpace(privateKey)
+
+	// the openssh-key-v1 magic, raw or base64 encoded
+	if strings.HasPrefix(privateKey, "openssh-key-v1") || strings.HasPrefix(privateKey, "b3BlbnNzaC1rZXktdjE") {
+		return true
+	}
+
+	// -----BEGIN <label>----- ... -----END <label>-----
+	lines := strings.Split(privateKey, "\n")
+	if len(lines) < 2 {
+		return false
+	}
+	firstLine := strings.TrimSpace(lines[0])
+	lastLine := strings.TrimSpace(lines[len(lines)-1])
+	if !strings.HasPrefix(firstLine, "-----BEGIN ") || !strings.HasSuffix(firstLine, "-----") {
+		return false
+	}
+	label := strings.TrimSuffix(strings.TrimPrefix(firstLine, "-----BEGIN "), "-----")
+	return lastLine == "-----END "+label+"-----"
+}
+
+func writePrivateKeyToFile(sshDir, privateKey string) (string, error) {
+	if !isPrivateKeyFormat(privateKey) {
+		return "", errors.New("auth_ssh_private_key does not look like a valid private key")
+	}
+	return writePrivateKeyFile(path.Join(sshDir, "bitrise"), privateKey)
+}
+
+func writePrivateKeyFile(privateKeyPath, privateKey string) (string, error) {
+	// ssh-keygen / ssh-add refuse keys without the closing newline
+	if !strings.HasSuffix(privateKey, "\n") {
+		privateKey += "\n"
+	}
+
+	if err := writeStringToFileWithPermission(privateKeyPath, privateKey, 0600); err != nil {
+		return "", fmt.Errorf("Failed to write private key (%s), err: %s", privateKeyPath, err)
+	}
+	return privateKeyPath, nil
+}
+
+// The GIT_SSH wrapper never prompts: with BatchMode ssh fails instead of waiting for input.
+// Every extra ssh argument is quoted, so those can't inject shell commands into the wrapper.
+func writeGitSSHWrapper(sshDir string, sshArgs []string) (string, error) {
+	sshCmd := "ssh -o StrictHostKeyChecking=no -o BatchMode=yes"
+	for _, arg := range sshArgs {
+		sshCmd += " " + shellQuote(arg)
+	}
+
+	wrapperPath := path.Join(sshDir, "bitrise_git_ssh")
+	wrapperCont := "#!/bin/bash\n" + sshCmd + " \"$@\"\n"
+	if err := writeStringToFileWithPermission(wrapperPath, wrapperCont, 0700); err != nil {
+		return "", fmt.Errorf("Failed to write GIT_SSH wrapper, err: %s", err)
+	}
+	return wrapperPath, nil
+}
+
+// sshProxyCommand returns a ProxyCommand which connects through the jump host ([user@]host[:port]).
+// Unlike ProxyJump (-J), it passes the keys and the non-interactive options to the jump host's ssh too.
+func sshProxyCommand(jumpHost string, identityArgs []string) string {
+	proxyArgs := []string{"-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes"}
+	proxyArgs = append(proxyArgs, identityArgs...)
+	if idx := strings.LastIndex(jumpHost, ":"); idx != -1 {
+		if _, err := strconv.Atoi(jumpHost[idx+1:]); err == nil {
+			proxyArgs = append(proxyArgs, "-p", jumpHost[idx+1:])
+			jumpHost = jumpHost[:idx]
+		}
+	}
+	proxyArgs = append(proxyArgs, "-W", "%h:%p", jumpHost)
+
+	// ssh runs the ProxyCommand with the shell
+	proxyCmd := "ssh"
+	for _, arg := range proxyArgs {
+		proxyCmd += " " + shellQuote(arg)
+	}
+	return proxyCmd
+}
+
+// writeAdditionalPrivateKeys writes every host's key and an ssh config, which selects the key by the host
+func writeAdditionalPrivateKeys(sshDir string, hostKeys []KeyValueModel) (string, error) {
+	sshConfigCont := ""
+	for _, hostKey := range hostKeys {
+		keyPath, err := writePrivateKeyFile(path.Join(sshDir, "bitrise_"+sanitizeFileName(hostKey.Key)), hostKey.Value)
+		if err != nil {
+			return "", err
+		}
+		sshConfigCont += fmt.Sprintf("Host %s\n  IdentityFile \"%s\"\n\n", hostKey.Key, keyPath)
+	}
+
+	sshConfigPath := path.Join(sshDir, "bitrise_ssh_config")
+	if err := writeStringToFileWithPermission(sshConfigPath, sshConfigCont, 0600); err != nil {
+		return "", fmt.Errorf("Failed to write ssh config, err: %s", err)
+	}
+	return sshConfigPath, nil
+}
+
+func startSSHAgent() error {
+	outBuffer := bytes.Buffer{}
+	errBuffer := bytes.Buffer{}
+
+	cmd := exec.Command("ssh-agent", "-s")
+	cmd.Stdin = nil
+	cmd.Stdout = io.Writer(&outBuffer)
+	cmd.Stderr = io.Writer(&errBuffer)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ssh-agent failed, err: %s, details: %s", err, errBuffer.String())
+	}
+
+	// output format: SSH_AUTH_SOCK=/tmp/ssh-XXX/agent.123; export SSH_AUTH_SOCK;
+	for _, line := range strings.Split(outBuffer.String(), "\n") {
+		assignment := strings.Split(line, ";")[0]
+		keyValue := strings.SplitN(assignment, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		if keyValue[0] == "SSH_AUTH_SOCK" || keyValue[0] == "SSH_AGENT_PID" {
+			if err := os.Setenv(keyValue[0], keyValue[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if os.Getenv("SSH_AUTH_SOCK") == "" {
+		return fmt.Errorf("Failed to parse ssh-agent output: %s", outBuffer.String())
+	}
+	return nil
+}
+
+func stopSSHAgent() {
+	cmd := exec.Command("ssh-agent", "-k")
+	cmd.Stdin = nil
+	cmd.Stdout = nil
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		fmt.Printf(" [!] Failed to stop ssh-agent, err: %s\n", err)
+	}
+}
+
+// the passphrase is passed to the askpass script in the environment, so it's never written to the disk
+func doSSHAdd(sshDir, privateKeyPath, passphrase string) error {
+	askpassPath := path.Join(sshDir, "bitrise_ssh_askpass")
+	if err := writeStringToFileWithPermission(askpassPath, "#!/bin/bash\necho \"$BITRISE_SSH_PASSPHRASE\"\n", 0700); err != nil {
+		return fmt.Errorf("Failed to write SSH_ASKPASS script, err: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(askpassPath); err != nil {
+			fmt.Printf(" [!] Failed to remove SSH_ASKPASS script, err: %s\n", err)
+		}
+	}()
+
+	cmd := exec.Command("ssh-add", privateKeyPath)
+	cmd.Stdin = nil
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ssh-add only uses SSH_ASKPASS without a terminal and with DISPLAY set (or SSH_ASKPASS_REQUIRE=force)
+	cmd.Env = append(os.Environ(),
+		"SSH_ASKPASS="+askpassPath,
+		"SSH_ASKPASS_REQUIRE=force",
+		"DISPLAY=:0",
+		"BITRISE_SSH_PASSPHRASE="+passphrase)
+
+	return cmd.Run()
+}
+
+// setGitEnvs sets the git_env variables for the step's process, so every git command inherits those
+func setGitEnvs(gitEnvs []KeyValueModel) error {
+	for _, gitEnv := range gitEnvs {
+		if err := os.Setenv(gitEnv.Key, gitEnv.Value); err != nil {
+			return fmt.Errorf("failed to set %s, err: %s", gitEnv.Key, err)
+		}
+	}
+	return nil
+}
+
+// setupTerminalPrompt makes the git commands fail immediately on missing credentials,
+// instead of waiting for a terminal prompt, unless allowTerminalPrompt is set
+func setupTerminalPrompt(allowTerminalPrompt bool) error {
+	if allowTerminalPrompt {
+		return nil
+	}
+	return os.Setenv("GIT_TERMINAL_PROMPT", "0")
+}
+
+// setupSSHAuth writes the private key(s) and points GIT_SSH to a wrapper which uses those,
+// so every git command (fetch, submodule update) authenticates with the key(s).
+// privateKey is optional, if only additional (per host) keys are used.
+// The returned cleanup function has to be called once the git commands finished.
+func setupSSHAuth(configs ConfigsModel, privateKey string) (func(), error) {
+	cleanups := []func(){}
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+
+	sshDir := ""
+	if configs.UseTempSSHDir {
+		// isolated from the user's ssh setup, created with 0700 and removed by the cleanup
+		tempSSHDir, err := ioutil.TempDir("", "bitrise_ssh")
+		if err != nil {
+			return cleanup, fmt.Errorf("Failed to create temp ssh dir, err: %s", err)
+		}
+		cleanups = append(cleanups, func() {
+			if err := os.RemoveAll(tempSSHDir); err != nil {
+				fmt.Printf(" [!] Failed to remove temp ssh dir (%s), err: %s\n", tempSSHDir, err)
+			}
+		})
+		sshDir = tempSSHDir
+	} else {
+		resolvedSSHDir, err := resolveSSHDir(configs.SSHDir)
+		if err != nil {
+			return cleanup, err
+		}
+		sshDir = resolvedSSHDir
+	}
+
+	sshArgs := []string{}
+	// the keys are passed to the jump host's ssh too
+	identityArgs := []string{}
+	if privateKey != "" {
+		privateKeyPath, err := writePrivateKeyToFile(sshDir, privateKey)
+		if err != nil {
+			return cleanup, err
+		}
+
+		// a key with passphrase is served by an ssh-agent
+		if configs.AuthSSHPassphrase != "" {
+			if err := startSSHAgent(); err != nil {
+				return cleanup, fmt.Errorf("Failed to start ssh-agent, err: %s", err)
+			}
+			cleanups = append(cleanups, stopSSHAgent)
+
+			if err := doSSHAdd(sshDir, privateKeyPath, configs.AuthSSHPassphrase); err != nil {
+				return cleanup, fmt.Errorf("Failed to add the private key to the ssh-agent, err: %s", err)
+			}
+		} else {
+			sshArgs = append(sshArgs, "-i", privateKeyPath)
+			identityArgs = append(identityArgs, "-i", privateKeyPath)
+		}
+	}
+
+	// ssh uses the first port option, so it takes precedence over the port of an ssh:// url (passed by git)
+	if configs.SSHPort != "" {
+		sshArgs = append(sshArgs, "-p", configs.SSHPort)
+	}
+	sshArgs = append(sshArgs, configs.SSHOptions...)
+
+	if len(configs.AdditionalSSHPrivateKeys) > 0 {
+		sshConfigPath, err := writeAdditionalPrivateKeys(sshDir, configs.AdditionalSSHPrivateKeys)
+		if err != nil {
+			return cleanup, err
+		}
+		sshArgs = append(sshArgs, "-F", sshConfigPath)
+		identityArgs = append(identityArgs, "-F", sshConfigPath)
+	}
+
+	if configs.SSHProxyJump != "" {
+		sshArgs = append(sshArgs, "-o", "ProxyCommand="+sshProxyCommand(configs.SSHProxyJump, identityArgs))
+	}
+
+	wrapperPath, err := writeGitSSHWrapper(sshDir, sshArgs)
+	if err != nil {
+		return cleanup, err
+	}
+	return cleanup, os.Setenv("GIT_SSH", wrapperPath)
+}
+
+// getGitOutput runs git in the given dir and returns its (unmodified) stdout
+func getGitOutput(runner CommandRunner, dir string, args ...string) (string, error) {
+	outBuffer := bytes.Buffer{}
+	errBuffer := bytes.Buffer{}
+
+	if err := runner.Run(context.Background(), dir, nil, &outBuffer, &errBuffer, gitBinary, withGitGlobalArgs(args)...); err != nil {
+		return "", fmt.Errorf("git %s failed, err: %s, details: %s", args[0], err, errBuffer.String())
+	}
+	return outBuffer.String(), nil
+}
+
+func isCommitHash(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, r := range ref {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSCPLikeURL reports whether the url is in the scp-like [user@]host:path form
+func isSCPLikeURL(repoURL string) bool {
+	if strings.Contains(repoURL, "://") {
+		return false
+	}
+	colonIdx := strings.Index(repoURL, ":")
+	slashIdx := strings.Index(repoURL, "/")
+	return colonIdx > 0 && (slashIdx == -1 || colonIdx < slashIdx)
+}
+
+// getRepositoryHost returns the host of an url or an scp-like url (user@host:path), without the user and the port
+func getRepositoryHost(repoURL string) (string, error) {
+	if isLocalPathURL(repoURL) {
+		return "", fmt.Errorf("local repository path (%s) has no host", repoURL)
+	}
+	if isSCPLikeURL(repoURL) {
+		host := repoURL[:strings.Index(repoURL, ":")]
+		return host[strings.LastIndex(host, "@")+1:], nil
+	}
+
+	parsedURL, err := url.Parse(repoURL)
+	if err != nil {
+		return "", err
+	}
+	if parsedURL.Hostname() == "" {
+		return "", fmt.Errorf("url (%s) has no host", repoURL)
+	}
+	return parsedURL.Hostname(), nil
+}
+
+// getSSHURLPort returns the port of an ssh://host:port url, or an empty string
+func getSSHURLPort(repoURL string) string {
+	if !strings.HasPrefix(repoURL, "ssh://") {
+		return ""
+	}
+	parsedURL, err := url.Parse(repoURL)
+	if err != nil {
+		return ""
+	}
+	return parsedURL.Port()
+}
+
+// validateAllowedHost fails if the repository url's host is not in the allowed hosts
+func validateAllowedHost(repoURL string, allowedHosts []string) error {
+	host, err := getRepositoryHost(repoURL)
+	if err != nil {
+		return err
+	}
+	for _, allowedHost := range allowedHosts {
+		if strings.EqualFold(host, allowedHost) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host (%s) is not allowed, allowed hosts: %s", host, strings.Join(allowedHosts, ", "))
+}
+
+func isSSHURL(repoURL string) bool {
+	for _, scheme := range []string{"ssh://", "git+ssh://", "ssh+git://"} {
+		if strings.HasPrefix(repoURL, scheme) {
+			return true
+		}
+	}
+	return isSCPLikeURL(repoURL)
+}
+
+// isLocalPathURL reports whether the url is a plain (absolute or relative) local path
+func isLocalPathURL(repoURL string) bool {
+	return !strings.Contains(repoURL, "://") && !isSCPLikeURL(repoURL)
+}
+
+func isHTTPURL(repoURL string) bool {
+	return strings.HasPrefix(repoURL, "https://") || strings.HasPrefix(repoURL, "http://")
+}
+
+// prepareRepositoryURL parses the repo uri
+//
+//	scp-like urls (git@host:path) are not valid urls, those are used as-is
+//	local paths are relative to the current dir, but git would resolve those relative to the clone destination
+func prepareRepositoryURL(repositoryURL string) (string, error) {
+	if isLocalPathURL(repositoryURL) {
+		absRepoPath, err := filepath.Abs(repositoryURL)
+		if err != nil {
+			return "", fmt.Errorf("Failed to expand path (%s), err: %s", repositoryURL, err)
+		}
+		if exist, err := isPathExists(absRepoPath); err != nil {
+			return "", fmt.Errorf("Failed to check path (%s), err: %s", absRepoPath, err)
+		} else if !exist {
+			return "", fmt.Errorf("Local repository does not exist at: %s", absRepoPath)
+		}
+		return absRepoPath, nil
+	}
+	if isSCPLikeURL(repositoryURL) {
+		return repositoryURL, nil
+	}
+
+	preparedRepoURL, err := url.Parse(repositoryURL)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse repo url (%s), err: %s", repositoryURL, err)
+	}
+	return preparedRepoURL.String(), nil
+}
+
+// selectAuthMethod picks the auth method based on the url scheme:
+// ssh urls use the private key, http(s) urls use the username and password (token).
+// The returned warnings list the provided credentials which won't be used.
+func selectAuthMethod(repoURL, sshPrivateKey, user, password string) (AuthMethod, []string) {
+	warnings := []string{}
+	hasSSHKey := sshPrivateKey != ""
+	hasHTTPSCredentials := user != "" || password != ""
+
+	switch {
+	case isSSHURL(repoURL):
+		if hasHTTPSCredentials {
+			warnings = append(warnings, "auth_user / auth_password is provided, but won't be used for an ssh repository url")
+		}
+		if hasSSHKey {
+			return AuthMethodSSHKey, warnings
+		}
+	case isHTTPURL(repoURL):
+		if hasSSHKey {
+			warnings = append(warnings, "auth_ssh_private_key is provided, but won't be used for an http(s) repository url")
+		}
+		if hasHTTPSCredentials {
+			return AuthMethodHTTPS, warnings
+		}
+	default:
+		// local repositories (file:// or plain path) are fetched directly
+		if hasSSHKey || hasHTTPSCredentials {
+			warnings = append(warnings, "Credentials are provided, but won't be used for this repository url")
+		}
+	}
+	return AuthMethodNone, warnings
+}
+
+// setupHTTPSAuth points GIT_ASKPASS to a script which answers git's username and password prompts.
+// The credentials are passed to the script in the environment, so those are never written to the disk.
+func setupHTTPSAuth(user, password string) (func(), error) {
+	askpassPath, cleanup, err := writeAskpassScript()
+	if err != nil {
+		return cleanup, err
+	}
+
+	for _, keyValue := range httpsAuthEnv(user, password, askpassPath) {
+		keyAndValue := strings.SplitN(keyValue, "=", 2)
+		if err := os.Setenv(keyAndValue[0], keyAndValue[1]); err != nil {
+			return cleanup, err
+		}
+	}
+	return cleanup, nil
+}
+
+// writeAskpassScript writes the GIT_ASKPASS script, which reads the credentials from httpsAuthEnv
+func writeAskpassScript() (string, func(), error) {
+	cleanup := func() {}
+
+	askpassFile, err := ioutil.TempFile("", "bitrise_git_askpass")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("Failed to create GIT_ASKPASS script, err: %s", err)
+	}
+	askpassPath := askpassFile.Name()
+	if err := askpassFile.Close(); err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() {
+		if err := os.Remove(askpassPath); err != nil {
+			fmt.Printf(" [!] Failed to remove GIT_ASKPASS script, err: %s\n", err)
+		}
+	}
+
+	askpassCont := `#!/bin/bash
+case "$1" in
+  Username*) echo "$BITRISE_GIT_AUTH_USER" ;;
+  *) echo "$BITRISE_GIT_AUTH_PASSWORD" ;;
+esac
+`
+	if err := writeStringToFileWithPermission(askpassPath, askpassCont, 0700); err != nil {
+		return "", cleanup, fmt.Errorf("Failed to write GIT_ASKPASS script, err: %s", err)
+	}
+	return askpassPath, cleanup, nil
+}
+
+// httpsAuthEnv is the environment (KEY=VALUE) which makes git use the askpass script with the credentials
+func httpsAuthEnv(user, password, askpassPath string) []string {
+	return []string{
+		"BITRISE_GIT_AUTH_USER=" + user,
+		"BITRISE_GIT_AUTH_PASSWORD=" + password,
+		"GIT_ASKPASS=" + askpassPath,
+	}
+}
+
+// parseGitVersion parses the output of git --version,
+// e.g.: git version 2.24.3 (Apple Git-128) or git version 2.20.1.windows.1
+func parseGitVersion(versionOut string) (int, int, int, error) {
+	fields := strings.Fields(versionOut)
+	if len(fields) < 3 || fields[0] != "git" || fields[1] != "version" {
+		return 0, 0, 0, fmt.Errorf("unexpected git version output: %s", versionOut)
+	}
+
+	versionParts := strings.Split(fields[2], ".")
+	if len(versionParts) < 2 {
+		return 0, 0, 0, fmt.Errorf("unexpected git version output: %s", versionOut)
+	}
+
+	version := []int{0, 0, 0}
+	for i := 0; i < len(version) && i < len(versionParts); i++ {
+		// release candidates are reported as e.g. 2.39.0-rc1
+		digits := strings.SplitN(versionParts[i], "-", 2)[0]
+		number, err := strconv.Atoi(digits)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("unexpected git version output: %s, err: %s", versionOut, err)
+		}
+		version[i] = number
+	}
+	return version[0], version[1], version[2], nil
+}
+
+func gitVersion(runner CommandRunner) (int, int, int, error) {
+	out, err := getGitOutput(runner, "", "--version")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return parseGitVersion(out)
+}
+
+// requiredGitFeatures lists the enabled options which require a minimum git version
+func requiredGitFeatures(configs ConfigsModel) []GitFeatureModel {
+	features := []GitFeatureModel{}
+	if configs.CloneFilter != "" {
+		features = append(features, GitFeatureModel{Name: "clone_filter", MinimumMajor: 2, MinimumMinor: 19})
+	}
+	if configs.CheckoutDefaultBranch {
+		features = append(features, GitFeatureModel{Name: "checkout_default_branch", MinimumMajor: 2, MinimumMinor: 8})
+	}
+	if configs.ShallowSince != "" {
+		features = append(features, GitFeatureModel{Name: "shallow_since", MinimumMajor: 2, MinimumMinor: 11})
+	}
+	if configs.FetchPruneTags {
+		features = append(features, GitFeatureModel{Name: "fetch_prune_tags", MinimumMajor: 2, MinimumMinor: 17})
+	}
+	if configs.MaxDeepen > 0 {
+		features = append(features, GitFeatureModel{Name: "max_deepen", MinimumMajor: 2, MinimumMinor: 11})
+	}
+	return features
+}
+
+func checkGitVersion(features []GitFeatureModel, major, minor int) error {
+	for _, feature := range features {
+		if major < feature.MinimumMajor || (major == feature.MinimumMajor && minor < feature.MinimumMinor) {
+			return fmt.Errorf("%s requires git >= %d.%d (installed: %d.%d)", feature.Name, feature.MinimumMajor, feature.MinimumMinor, major, minor)
+		}
+	}
+	return nil
+}
+
+func getGitLog(runner CommandRunner, cloneIntoDir, formatParam string) (string, error) {
+	return getGitOutput(runner, cloneIntoDir, "log", "-1", "--format="+formatParam)
+}
+
+// isRelativeRevision reports whether the revision is relative to an other one, e.g. HEAD~2, main~5 or main^2
+func isRelativeRevision(revision string) bool {
+	return strings.IndexAny(revision, "~^") > 0
+}
+
+// resolveRelativeRevision resolves the relative revision to a commit hash.
+// HEAD means the branch's tip (if provided) or the remote's default branch, as nothing is checked out yet.
+func resolveRelativeRevision(runner CommandRunner, cloneIntoDir, revision, branch string) (string, error) {
+	idx := strings.IndexAny(revision, "~^")
+	base, suffix := revision[:idx], revision[idx:]
+	if base == "HEAD" {
+		if branch == "" {
+			defaultBranch, err := getRemoteDefaultBranch(runner, cloneIntoDir)
+			if err != nil {
+				return "", err
+			} else if defaultBranch == "" {
+				return "", errors.New("the remote reports no HEAD, can't detect its default branch")
+			}
+			branch = defaultBranch
+		}
+		base = branch
+	}
+	// the fetched branches are remote-tracking refs only
+	if isGitRefExists(runner, cloneIntoDir, "refs/remotes/origin/"+base) {
+		base = "refs/remotes/origin/" + base
+	}
+
+	out, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "--verify", "--quiet", base+suffix+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%s is not a commit in the fetched history", revision)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// preflightCheck fails fast, before anything is created, if the repository is not reachable
+// or none of the refs (if any) exists. It uses the same ssh / https authentication as the fetch.
+func preflightCheck(runner CommandRunner, repositoryURL string, refs []string) error {
+	args := []string{"ls-remote", repositoryURL}
+	if len(refs) > 0 {
+		args = append(args, refs...)
+	} else {
+		// only the reachability is checked, listing every ref could be slow
+		args = append(args, "HEAD")
+	}
+
+	out, err := getGitOutput(runner, "", args...)
+	if err != nil {
+		return fmt.Errorf("the repository is not reachable (the host is unreachable, the authentication failed or the repository does not exist), err: %s", err)
+	}
+	if len(refs) > 0 && strings.TrimSpace(out) == "" {
+		return fmt.Errorf("ref not found in the repository: %s", strings.Join(refs, " or "))
+	}
+	return nil
+}
+
+// getPreflightRefs returns the refs the checkout requires, a commit can't be checked with ls-remote
+func getPreflightRefs(configs ConfigsModel, gitCheckoutParam string) []string {
+	if configs.CustomFetchRefspec != "" || configs.Commit != "" {
+		return nil
+	}
+	if configs.PullRequestID != "" {
+		return []string{"refs/pull/" + configs.PullRequestID + "/merge", "refs/pull/" + configs.PullRequestID + "/head"}
+	}
+	if configs.Tag != "" {
+		return []string{"refs/tags/" + configs.Tag}
+	}
+	if configs.RemoteBranch != "" {
+		return []string{"refs/heads/" + configs.RemoteBranch}
+	}
+	if gitCheckoutParam != "" {
+		return []string{"refs/heads/" + gitCheckoutParam}
+	}
+	return nil
+}
+
+// getRemoteDefaultBranch returns an empty string if the remote reports no HEAD
+func getRemoteDefaultBranch(runner CommandRunner, cloneIntoDir string) (string, error) {
+	// output format: ref: refs/heads/master<TAB>HEAD
+	out, err := getGitOutput(runner, cloneIntoDir, "ls-remote", "--symref", "origin", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "ref:") {
+			continue
+		}
+		ref := strings.TrimSpace(strings.Split(strings.TrimPrefix(line, "ref:"), "\t")[0])
+		return strings.TrimPrefix(ref, "refs/heads/"), nil
+	}
+	return "", nil
+}
+
+// getCommitStats collects the HEAD commit's details, every failure is only logged
+// (e.g. an empty repository has no commits yet)
+func getCommitStats(runner CommandRunner, cloneIntoDir, commitLogFormat, changedFilesAgainst string) map[string]string {
+	commitStats := map[string]string{}
+
+	// peeled to the commit, so an annotated and a lightweight tag's checkout exports the same hash
+	commitHashStr, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "HEAD^{commit}")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_COMMIT_HASH"] = commitHashStr
+
+	commitMsgSubjectStr, err := getGitLog(runner, cloneIntoDir, "%s")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_COMMIT_MESSAGE_SUBJECT"] = commitMsgSubjectStr
+
+	commitMsgBodyStr, err := getGitLog(runner, cloneIntoDir, "%b")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_COMMIT_MESSAGE_BODY"] = commitMsgBodyStr
+
+	commitAuthorNameStr, err := getGitLog(runner, cloneIntoDir, "%an")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_COMMIT_AUTHOR_NAME"] = commitAuthorNameStr
+
+	commitAuthorEmailStr, err := getGitLog(runner, cloneIntoDir, "%ae")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_COMMIT_AUTHOR_EMAIL"] = commitAuthorEmailStr
+
+	commitCommiterNameStr, err := getGitLog(runner, cloneIntoDir, "%cn")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_COMMIT_COMMITER_NAME"] = commitCommiterNameStr
+
+	commitCommiterEmailStr, err := getGitLog(runner, cloneIntoDir, "%ce")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_COMMIT_COMMITER_EMAIL"] = commitCommiterEmailStr
+
+	commitParentHashesStr, err := getGitLog(runner, cloneIntoDir, "%P")
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitParentHashes := strings.Fields(commitParentHashesStr)
+	commitStats["GIT_CLONE_COMMIT_PARENT_HASHES"] = strings.Join(commitParentHashes, " ")
+	commitStats["GIT_CLONE_COMMIT_IS_MERGE"] = fmt.Sprintf("%v", len(commitParentHashes) > 1)
+
+	if commitLogFormat != "" {
+		commitLogStr, err := getGitLog(runner, cloneIntoDir, commitLogFormat)
+		if err != nil {
+			fmt.Println(err)
+		}
+		commitStats["GIT_CLONE_COMMIT_LOG"] = commitLogStr
+	}
+
+	changedFiles, err := getChangedFiles(runner, cloneIntoDir, changedFilesAgainst)
+	if err != nil {
+		fmt.Println(err)
+	}
+	commitStats["GIT_CLONE_CHANGED_FILES"] = strings.Join(changedFiles, "\n")
+
+	return commitStats
+}
+
+// getChangedFiles returns the files changed by HEAD, or the files which differ from the against ref if provided
+// (e.g. the base branch of a merge commit). The initial commit has no changed files.
+func getChangedFiles(runner CommandRunner, cloneIntoDir, against string) ([]string, error) {
+	// -z: the names are neither quoted nor split (e.g. at a space)
+	args := []string{"diff-tree", "-z", "--no-commit-id", "--name-only", "-r", "HEAD"}
+	if against != "" {
+		// a branch name is resolved to its remote-tracking branch, if there is no such local ref
+		if !isGitRefExists(runner, cloneIntoDir, against) && isGitRefExists(runner, cloneIntoDir, "refs/remotes/origin/"+against) {
+			against = "refs/remotes/origin/" + against
+		}
+		args = []string{"diff", "-z", "--name-only", against, "HEAD"}
+	}
+
+	out, err := getGitOutput(runner, cloneIntoDir, args...)
+	if err != nil {
+		return nil, err
+	}
+	return splitNulTerminated(out), nil
+}
+
+// splitNulTerminated splits the output of a git command run with -z
+func splitNulTerminated(out string) []string {
+	items := []string{}
+	for _, item := range strings.Split(out, "\x00") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// checkoutPullRequestHeadCommit checks out the pinned commit of the pull request,
+// it is fetched by its hash if the pull request's ref did not bring it
+func checkoutPullRequestHeadCommit(runner CommandRunner, configs ConfigsModel) error {
+	cloneIntoDir := configs.CloneIntoDir
+	commit := configs.PullRequestHeadCommit
+
+	if !isGitRefExists(runner, cloneIntoDir, commit+"^{commit}") {
+		commitFetchParams := FetchParamsModel{
+			CommitHash:   commit,
+			Depth:        configs.CloneDepth,
+			ShowProgress: configs.ShowProgress,
+		}
+		if err := retryCommand("Pull request head commit fetch", configs.RetryCount, configs.RetryWaitTime, func() error {
+			return doGitFetch(runner, cloneIntoDir, commitFetchParams)
+		}); err != nil {
+			return fmt.Errorf("Could not fetch the pull request's head commit (%s), err: %s", commit, err)
+		}
+	}
+
+	fmt.Printf("Checking out the pull request's pinned head commit: %s\n", commit)
+	if err := doGitCheckout(runner, cloneIntoDir, commit, configs.ForceCheckout); err != nil {
+		return fmt.Errorf("Could not do checkout (%s), err: %s", commit, err)
+	}
+
+	// GIT_CLONE_PULL_REQUEST_ID is exported with the commit stats
+	exportOutput("GIT_CLONE_PULL_REQUEST_HEAD_COMMIT", commit)
+	return nil
+}
+
+// verifyCommitSignature verifies HEAD's signature with git verify-commit, and returns its status (good, bad or none).
+// If publicKeys is provided, those are imported into a temporary GNUPGHOME used for the verification,
+// otherwise the user's keyring is used.
+func verifyCommitSignature(runner CommandRunner, cloneIntoDir, publicKeys string) (string, error) {
+	if publicKeys != "" {
+		gnupgHome, err := ioutil.TempDir("", "bitrise_gnupg")
+		if err != nil {
+			return "bad", fmt.Errorf("Failed to create GNUPGHOME, err: %s", err)
+		}
+		defer func() {
+			if err := os.RemoveAll(gnupgHome); err != nil {
+				fmt.Printf(" [!] Failed to remove GNUPGHOME (%s), err: %s\n", gnupgHome, err)
+			}
+		}()
+
+		originalGnupgHome, isGnupgHomeSet := os.LookupEnv("GNUPGHOME")
+		if err := os.Setenv("GNUPGHOME", gnupgHome); err != nil {
+			return "bad", err
+		}
+		defer func() {
+			restoreErr := os.Unsetenv("GNUPGHOME")
+			if isGnupgHomeSet {
+				restoreErr = os.Setenv("GNUPGHOME", originalGnupgHome)
+			}
+			if restoreErr != nil {
+				fmt.Printf(" [!] Failed to restore GNUPGHOME, err: %s\n", restoreErr)
+			}
+		}()
+
+		publicKeysPath := filepath.Join(gnupgHome, "public_keys.asc")
+		if err := writeStringToFileWithPermission(publicKeysPath, publicKeys, 0600); err != nil {
+			return "bad", fmt.Errorf("Failed to write the public keys, err: %s", err)
+		}
+		if err := runner.Run(context.Background(), cloneIntoDir, nil, os.Stdout, os.Stderr, "gpg", "--batch", "--import", publicKeysPath); err != nil {
+			return "bad", fmt.Errorf("Failed to import the public keys, err: %s", err)
+		}
+	}
+
+	// %G? is N for an unsigned commit
+	signature, err := getGitLog(runner, cloneIntoDir, "%G?")
+	if err != nil {
+		return "bad", err
+	}
+	if strings.TrimSpace(signature) == "N" {
+		return "none", errors.New("the commit is not signed")
+	}
+
+	if err := runGitCommand(runner, cloneIntoDir, "verify-commit", "HEAD"); err != nil {
+		return "bad", err
+	}
+	return "good", nil
+}
+
+// mergeBaseBranchLocally fetches base_branch and merges it into the checked out pull request head,
+// the result (clean / conflict) is exported as GIT_CLONE_MERGE_RESULT
+func mergeBaseBranchLocally(runner CommandRunner, configs ConfigsModel) error {
+	cloneIntoDir := configs.CloneIntoDir
+
+	baseFetchParams := FetchParamsModel{
+		SingleBranch: configs.BaseBranch,
+		Depth:        configs.CloneDepth,
+		ShowProgress: configs.ShowProgress,
+	}
+	if err := retryCommand("Base branch fetch", configs.RetryCount, configs.RetryWaitTime, func() error {
+		return doGitFetch(runner, cloneIntoDir, baseFetchParams)
+	}); err != nil {
+		return fmt.Errorf("Could not fetch the base branch (%s), err: %s", configs.BaseBranch, err)
+	}
+
+	fmt.Printf("Merging %s into the pull request's head\n", configs.BaseBranch)
+	conflicts, err := doGitLocalMerge(runner, cloneIntoDir, "refs/remotes/origin/"+configs.BaseBranch)
+
+	mergeResult := "clean"
+	if len(conflicts) > 0 {
+		mergeResult = "conflict"
+	}
+	if err == nil || len(conflicts) > 0 {
+		exportOutput("GIT_CLONE_MERGE_RESULT", mergeResult)
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("Merging the base branch (%s) resulted in conflicts: %s", configs.BaseBranch, strings.Join(conflicts, ", "))
+	}
+	if err != nil {
+		return fmt.Errorf("Could not merge the base branch (%s), err: %s", configs.BaseBranch, err)
+	}
+	return nil
+}
+
+// verifyCommitOnBranch fails if the checked out commit is not an ancestor of the fetched branch's tip
+func verifyCommitOnBranch(runner CommandRunner, cloneIntoDir, commit, branch string) error {
+	headHash, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("Could not get the checked out commit, err: %s", err)
+	}
+	// the merge base of an ancestor is the ancestor itself, unrelated histories have none (exit code 1)
+	mergeBase, err := getGitOutput(runner, cloneIntoDir, "merge-base", "HEAD", "refs/remotes/origin/"+branch)
+	if err != nil || strings.TrimSpace(mergeBase) != strings.TrimSpace(headHash) {
+		return fmt.Errorf("The commit (%s) is not reachable from the branch (%s)", commit, branch)
+	}
+	return nil
+}
+
+// doGitMirrorPush fetches every branch and tag of the repository into a temporary bare repository,
+// then pushes them to the mirror, and removes its other refs.
+// The clone's own refs can't be used: a single branch, commit, pull request or shallow clone
+// only has a part of them, and pruning the mirror to those would delete the rest.
+// The mirror is authenticated with mirror_auth_user and mirror_auth_password (https only) if provided,
+// otherwise with the same ssh / https authentication as the fetch.
+func doGitMirrorPush(runner CommandRunner, configs ConfigsModel) error {
+	mirrorDir, err := ioutil.TempDir("", "bitrise_mirror")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp mirror dir, err: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(mirrorDir); err != nil {
+			fmt.Printf(" [!] Failed to remove temp mirror dir (%s), err: %s\n", mirrorDir, err)
+		}
+	}()
+
+	if err := doGitInit(runner, mirrorDir, true, ""); err != nil {
+		return fmt.Errorf("Could not init the mirror repository, err: %s", err)
+	}
+	for _, gitConfig := range configs.GitConfigs {
+		if err := doGitConfig(runner, mirrorDir, gitConfig.Key, gitConfig.Value); err != nil {
+			return fmt.Errorf("Could not set git config (%s), err: %s", gitConfig.Key, err)
+		}
+	}
+	if err := doGitAddRemote(runner, mirrorDir, "origin", configs.RepositoryURL); err != nil {
+		return fmt.Errorf("Could not add remote, err: %s", err)
+	}
+	if err := doGitAddRemote(runner, mirrorDir, "mirror", configs.MirrorToURL); err != nil {
+		return fmt.Errorf("Could not add mirror remote, err: %s", err)
+	}
+
+	fmt.Println("Fetching every branch and tag for the mirror")
+	fullFetchParams := FetchParamsModel{
+		Refspecs:     []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+		ShowProgress: configs.ShowProgress,
+	}
+	if err := retryCommand("Mirror fetch", configs.RetryCount, configs.RetryWaitTime, func() error {
+		return doGitFetch(runner, mirrorDir, fullFetchParams)
+	}); err != nil {
+		return fmt.Errorf("Could not fetch the repository for the mirror, err: %s", err)
+	}
+
+	// only the push's environment is set up, so the fetch and the rest of the step are still authenticated as the clone
+	var pushEnv []string
+	if configs.MirrorAuthUser != "" || configs.MirrorAuthPassword != "" {
+		askpassPath, cleanupAskpass, err := writeAskpassScript()
+		defer cleanupAskpass()
+		if err != nil {
+			return fmt.Errorf("Failed to set up the mirror's HTTPS authentication, err: %s", err)
+		}
+		pushEnv = httpsAuthEnv(configs.MirrorAuthUser, configs.MirrorAuthPassword, askpassPath)
+	}
+
+	fmt.Println("Pushing to the mirror")
+	return retryCommand("Mirror push", configs.RetryCount, configs.RetryWaitTime, func() error {
+		return runGitCommandWithContext(context.Background(), runner, mirrorDir, pushEnv, "push", "--force", "--prune", "mirror", "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	})
+}
+
+// setBareRepositoryHead points the bare repository's HEAD to the selected branch
+// (to the remote's default one if a tag or a commit is selected), and returns the selected commit's hash
+func setBareRepositoryHead(runner CommandRunner, configs ConfigsModel, gitCheckoutParam string) (string, error) {
+	cloneIntoDir := configs.CloneIntoDir
+
+	headBranch := ""
+	selectedRef := ""
+	if configs.CustomFetchRefspec != "" {
+		selectedRef = gitCheckoutParam
+	} else if configs.PullRequestID != "" {
+		headBranch = gitCheckoutParam
+	} else if configs.Commit != "" {
+		headBranch = configs.RemoteBranch
+		// a relative commit (e.g. HEAD~2) is resolved from the HEAD set below
+		selectedRef = configs.Commit
+	} else if configs.Tag != "" {
+		selectedRef = "refs/tags/" + configs.Tag
+	} else if configs.RemoteBranch != "" {
+		headBranch = configs.RemoteBranch
+	}
+
+	if headBranch != "" && !isGitRefExists(runner, cloneIntoDir, "refs/heads/"+headBranch) {
+		return "", fmt.Errorf("The branch (%s) was not fetched", headBranch)
+	}
+	if headBranch == "" && configs.CustomFetchRefspec == "" {
+		defaultBranch, err := getRemoteDefaultBranch(runner, cloneIntoDir)
+		if err != nil {
+			fmt.Printf(" [!] Failed to detect the remote's default branch, err: %s\n", err)
+		} else if isGitRefExists(runner, cloneIntoDir, "refs/heads/"+defaultBranch) {
+			headBranch = defaultBranch
+		}
+	}
+	if headBranch != "" {
+		if err := runGitCommand(runner, cloneIntoDir, "symbolic-ref", "HEAD", "refs/heads/"+headBranch); err != nil {
+			return "", fmt.Errorf("Could not point HEAD to the branch (%s), err: %s", headBranch, err)
+		}
+	}
+	if selectedRef == "" {
+		selectedRef = "HEAD"
+	}
+
+	out, err := getGitOutput(runner, cloneIntoDir, "rev-parse", selectedRef+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("Could not get the fetched commit's hash (%s), err: %s", selectedRef, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// doGitCloneWithRecovery clones, and with recover_from_corruption removes a corrupt repository and clones again from scratch.
+// The workspace outputs are exported once, after the final attempt: the previous commit is the one found
+// before the corrupt repository was removed, and the clone is incremental if the final attempt was.
+func doGitCloneWithRecovery(runner CommandRunner, configs ConfigsModel, gitCheckoutParam string) (map[string]string, error) {
+	workspaceOutputs := map[string]string{}
+	commitStats, err := doGitClone(runner, configs, gitCheckoutParam, workspaceOutputs)
+	// restarted only once, a second corrupt clone is not a local issue
+	if err != nil && configs.RecoverFromCorruption && isCorruptRepository(err) {
+		fmt.Printf(" [!] The repository is corrupt, cloning again from scratch, err: %s\n", err)
+		if removeErr := removeCloneDirs(configs); removeErr != nil {
+			err = fmt.Errorf("%s, failed to remove the corrupt repository, err: %s", err, removeErr)
+		} else {
+			previousCommitHash := workspaceOutputs["GIT_CLONE_PREVIOUS_COMMIT_HASH"]
+			commitStats, err = doGitClone(runner, configs, gitCheckoutParam, workspaceOutputs)
+			workspaceOutputs["GIT_CLONE_PREVIOUS_COMMIT_HASH"] = previousCommitHash
+		}
+	}
+
+	// not set if the clone failed before checking the clone destination dir
+	for _, key := range []string{"GIT_CLONE_PREVIOUS_COMMIT_HASH", "GIT_CLONE_WAS_INCREMENTAL"} {
+		value, ok := workspaceOutputs[key]
+		if !ok {
+			continue
+		}
+		exportOutput(key, value)
+	}
+	return commitStats, err
+}
+
+// removeCloneDirs removes the clone destination dir (and the separate git dir), before cloning again from scratch
+func removeCloneDirs(configs ConfigsModel) error {
+	for _, dir := range []string{configs.CloneIntoDir, configs.SeparateGitDir} {
+		if dir == "" {
+			continue
+		}
+		if isDangerousPathToRemove(dir) {
+			return fmt.Errorf("refusing to remove %s", dir)
+		}
+		fmt.Printf("Removing %s\n", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func doGitClone(runner CommandRunner, configs ConfigsModel, gitCheckoutParam string, workspaceOutputs map[string]string) (map[string]string, error) {
+	cloneIntoDir := configs.CloneIntoDir
+	var commitStats map[string]string
+
+	if fileInfo, exist, err := genericIsPathExists(cloneIntoDir); err != nil {
+		return nil, fmt.Errorf("Failed to check path (%s), err: %s", cloneIntoDir, err)
+	} else if exist && !fileInfo.IsDir() {
+		return nil, fmt.Errorf("clone_into_dir (%s) points to a file, expected a directory", cloneIntoDir)
+	}
+
+	// before force_clean_dir, so nothing is removed if the clone can't succeed
+	if configs.PreflightCheck {
+		fmt.Println("Checking the repository with ls-remote")
+		if err := preflightCheck(runner, configs.RepositoryURL, getPreflightRefs(configs, gitCheckoutParam)); err != nil {
+			return nil, fmt.Errorf("Preflight check failed, %s", err)
+		}
+	}
+
+	// the commit of the workspace's previous checkout (e.g. for an incremental diff), empty on a fresh clone
+	// (the clone dir might be inside an other repository, only its own .git counts)
+	previousCommitHash := ""
+	if exist, err := isPathExists(path.Join(cloneIntoDir, ".git")); err == nil && exist && isGitRefExists(runner, cloneIntoDir, "HEAD") {
+		if out, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "HEAD"); err == nil {
+			previousCommitHash = strings.TrimSpace(out)
+		}
+	}
+	workspaceOutputs["GIT_CLONE_PREVIOUS_COMMIT_HASH"] = previousCommitHash
+
+	if configs.ForceCleanDir {
+		if err := cleanDir(cloneIntoDir); err != nil {
+			return nil, fmt.Errorf("Failed to clean the clone destination dir (%s), err: %s", cloneIntoDir, err)
+		}
+	}
+
+	existingRepo, err := getExistingRepository(configs)
+	if err != nil {
+		return nil, err
+	}
+	isReusedRepo := false
+	if existingRepo != "" {
+		switch configs.ExistingGitDir {
+		case "fetch":
+			fmt.Printf("%s, fetching into it\n", existingRepo)
+			isReusedRepo = true
+		case "replace":
+			fmt.Printf("%s, replacing it\n", existingRepo)
+			if err := cleanDir(cloneIntoDir); err != nil {
+				return nil, fmt.Errorf("Failed to clean the clone destination dir (%s), err: %s", cloneIntoDir, err)
+			}
+			if configs.SeparateGitDir != "" {
+				if err := cleanDir(configs.SeparateGitDir); err != nil {
+					return nil, fmt.Errorf("Failed to clean the separate git dir (%s), err: %s", configs.SeparateGitDir, err)
+				}
+			}
+		default:
+			return nil, errors.New(existingRepo)
+		}
+	}
+
+	gitCheckPath := path.Join(cloneIntoDir, ".git")
+	// a bare repository has its objects (and HEAD) at the top level
+	if configs.Bare {
+		gitCheckPath = path.Join(cloneIntoDir, "HEAD")
+	}
+
+	if err := os.MkdirAll(cloneIntoDir, 0777); err != nil {
+		return nil, fmt.Errorf("Failed to create the clone_destination_dir at: %s", cloneIntoDir)
+	}
+
+	if err := doGitInit(runner, cloneIntoDir, configs.Bare, configs.SeparateGitDir); err != nil {
+		return nil, fmt.Errorf("Could not init git repository (%s), err: %s", cloneIntoDir, err)
+	}
+	// git init is safe to rerun on a reused repository, it keeps the existing objects and refs
+	workspaceOutputs["GIT_CLONE_WAS_INCREMENTAL"] = fmt.Sprintf("%v", isReusedRepo)
+
+	// applied before git_config, so it can be overridden there
+	if configs.EnableProtocolV2 {
+		if err := doGitConfig(runner, cloneIntoDir, "protocol.version", "2"); err != nil {
+			return nil, fmt.Errorf("Could not set git config (protocol.version), err: %s", err)
+		}
+	}
+
+	for _, gitConfig := range configs.GitConfigs {
+		if err := doGitConfig(runner, cloneIntoDir, gitConfig.Key, gitConfig.Value); err != nil {
+			return nil, fmt.Errorf("Could not set git config (%s), err: %s", gitConfig.Key, err)
+		}
+	}
+
+	// set before the first checkout, so the files are converted when they are written to the working tree
+	if configs.AutoCRLF != "" {
+		if err := doGitConfig(runner, cloneIntoDir, "core.autocrlf", configs.AutoCRLF); err != nil {
+			return nil, fmt.Errorf("Could not set git config (core.autocrlf), err: %s", err)
+		}
+	}
+
+	// hooks are disabled only while the step runs, the previous config (e.g. set by git_config) is restored at the end
+	if configs.SkipHooks {
+		// exits with 1 if it's not set
+		previousHooksPath, getErr := getGitOutput(runner, cloneIntoDir, "config", "--local", "--get", "core.hooksPath")
+		previousHooksPath = strings.TrimSpace(previousHooksPath)
+		if err := doGitConfig(runner, cloneIntoDir, "core.hooksPath", os.DevNull); err != nil {
+			return nil, fmt.Errorf("Could not disable git hooks, err: %s", err)
+		}
+		defer func() {
+			if exist, err := isPathExists(gitCheckPath); err != nil || !exist {
+				return
+			}
+			var restoreErr error
+			if getErr == nil && previousHooksPath != "" {
+				restoreErr = doGitConfig(runner, cloneIntoDir, "core.hooksPath", previousHooksPath)
+			} else {
+				restoreErr = runGitCommand(runner, cloneIntoDir, "config", "--local", "--unset", "core.hooksPath")
+			}
+			if restoreErr != nil {
+				fmt.Printf(" [!] Failed to re-enable git hooks, err: %s\n", restoreErr)
+			}
+		}()
+	}
+
+	// an identity is required if git has to create a commit (e.g. merging a pull request)
+	if configs.GitUserName != "" {
+		if err := doGitConfig(runner, cloneIntoDir, "user.name", configs.GitUserName); err != nil {
+			return nil, fmt.Errorf("Could not set git config (user.name), err: %s", err)
+		}
+	}
+	if configs.GitUserEmail != "" {
+		if err := doGitConfig(runner, cloneIntoDir, "user.email", configs.GitUserEmail); err != nil {
+			return nil, fmt.Errorf("Could not set git config (user.email), err: %s", err)
+		}
+	}
+
+	if err := doGitAddRemote(runner, cloneIntoDir, "origin", configs.RepositoryURL); err != nil {
+		return nil, fmt.Errorf("Could not add remote, err: %s", err)
+	}
+	// a later fetch in the bare repository updates its own branches, not remote-tracking ones
+	if configs.Bare {
+		if err := doGitConfig(runner, cloneIntoDir, "remote.origin.fetch", "+refs/heads/*:refs/heads/*"); err != nil {
+			return nil, fmt.Errorf("Could not set git config (remote.origin.fetch), err: %s", err)
+		}
+	}
+	if configs.UpstreamRepositoryURL != "" {
+		if err := doGitAddRemote(runner, cloneIntoDir, "upstream", configs.UpstreamRepositoryURL); err != nil {
+			return nil, fmt.Errorf("Could not add upstream remote, err: %s", err)
+		}
+	}
+
+	// single branch fetch only makes sense if the checkout is driven by the branch
+	singleBranch := ""
+	if configs.SingleBranch && configs.CustomFetchRefspec == "" && configs.PullRequestID == "" && configs.Commit == "" && configs.Tag == "" {
+		singleBranch = configs.RemoteBranch
+	}
+	// the commit is fetched through its branch, e.g. if it's not reachable from the other branches
+	isCommitViaBranch := configs.FetchCommitViaBranch && configs.CustomFetchRefspec == "" && configs.PullRequestID == "" &&
+		configs.Commit != "" && configs.RemoteBranch != ""
+	if isCommitViaBranch {
+		singleBranch = configs.RemoteBranch
+	}
+
+	fetchParams := FetchParamsModel{
+		CustomRefspec: configs.CustomFetchRefspec,
+		PullRequestID: configs.PullRequestID,
+		CheckoutParam: gitCheckoutParam,
+		SingleBranch:  singleBranch,
+		Filter:        configs.CloneFilter,
+		Depth:         configs.CloneDepth,
+		ShallowSince:  configs.ShallowSince,
+		ShowProgress:  configs.ShowProgress,
+		Prune:         configs.FetchPrune,
+		PruneTags:     configs.FetchPruneTags,
+		MaxBytes:      configs.MaxFetchBytes,
+		// with tags_only_depth the tags are fetched separately
+		NoTags: configs.NoTags || configs.TagsOnlyDepth > 0,
+		// the tags of a reused repository might have been moved since its last fetch
+		UpdateTags: isReusedRepo,
+	}
+	// a commit which is not a branch tip might not be fetched by a plain fetch
+	if configs.CustomFetchRefspec == "" && configs.PullRequestID == "" && isCommitHash(configs.Commit) && !isCommitViaBranch {
+		fetchParams.CommitHash = configs.Commit
+	}
+
+	// the branches (and tags) are fetched as the bare repository's own refs, as with clone --bare
+	if configs.Bare && configs.CustomFetchRefspec == "" && configs.PullRequestID == "" {
+		branchRefspec := "+refs/heads/*:refs/heads/*"
+		if singleBranch != "" {
+			branchRefspec = "+refs/heads/" + singleBranch + ":refs/heads/" + singleBranch
+		}
+		fetchParams.Refspecs = []string{branchRefspec}
+		if !fetchParams.NoTags {
+			fetchParams.Refspecs = append(fetchParams.Refspecs, "+refs/tags/*:refs/tags/*")
+		}
+	}
+
+	// the ref which is actually checked out, exported as GIT_CLONE_CHECKOUT_REF
+	checkoutRef := gitCheckoutParam
+	isPullRequest := configs.CustomFetchRefspec == "" && configs.PullRequestID != ""
+	if isPullRequest {
+		checkoutRef = "pull/" + configs.PullRequestID + "/merge"
+	}
+
+	// the phase durations are exported right after the phase, and returned for the JSON output
+	phaseDurations := map[string]string{}
+	recordPhaseDuration := func(key string, startTime time.Time) {
+		phaseDurations[key] = fmt.Sprintf("%.2f", time.Since(startTime).Seconds())
+		exportOutput(key, phaseDurations[key])
+	}
+
+	fetch := func() error {
+		return doGitFetchWithFallbacks(runner, cloneIntoDir, fetchParams)
+	}
+	// only the retries fetch incrementally, the first attempt is a single fetch
+	if configs.ResumeStrategy == "deepen" {
+		isFirstAttempt := true
+		fetch = func() error {
+			if isFirstAttempt {
+				isFirstAttempt = false
+				return doGitFetchWithFallbacks(runner, cloneIntoDir, fetchParams)
+			}
+			return doGitFetchIncrementally(runner, cloneIntoDir, fetchParams)
+		}
+	}
+
+	// git refuses to fetch into the checked out branch (e.g. the pull request's branch) of a reused repository
+	if isReusedRepo && !configs.Bare && isGitRefExists(runner, cloneIntoDir, "HEAD") {
+		if err := runGitCommand(runner, cloneIntoDir, "checkout", "--detach"); err != nil {
+			return nil, fmt.Errorf("Could not detach HEAD of the existing repository, err: %s", err)
+		}
+	}
+
+	fetchStartTime := time.Now()
+	if err := retryCommand("Fetch", configs.RetryCount, configs.RetryWaitTime, fetch); err != nil {
+		if !isPullRequest || isFetchBudgetExceeded(err) {
+			return nil, fmt.Errorf("Could not fetch from repository, err: %s", err)
+		}
+
+		// GitHub has no merge ref for conflicting pull requests
+		fmt.Printf(" [!] Fetch of %s failed, falling back to the pull request's head ref, err: %s\n", checkoutRef, err)
+		fetchParams.PullRequestRef = "head"
+		if err := doGitFetchWithFallbacks(runner, cloneIntoDir, fetchParams); err != nil {
+			return nil, fmt.Errorf("Could not fetch from repository, err: %s", err)
+		}
+		checkoutRef = "pull/" + configs.PullRequestID + "/head"
+	}
+	recordPhaseDuration("GIT_CLONE_FETCH_DURATION_SECONDS", fetchStartTime)
+
+	// a freshly created repository has nothing to check out, it is only an error with require_checkout
+	isEmptyRepo := isEmptyRepository(runner, cloneIntoDir)
+	exportOutput("GIT_CLONE_IS_EMPTY_REPO", fmt.Sprintf("%t", isEmptyRepo))
+	if isEmptyRepo {
+		if configs.RequireCheckout {
+			return nil, errors.New("The repository is empty (it has no commits), but require_checkout is set")
+		}
+		fmt.Println(" [!] The repository is empty (it has no commits), skipping the checkout")
+		commitStats = map[string]string{"GIT_CLONE_IS_EMPTY_REPO": "true"}
+		for key, value := range phaseDurations {
+			commitStats[key] = value
+		}
+		return commitStats, nil
+	}
+
+	// e.g. the tags required for versioning, next to the branch's full history
+	if configs.TagsOnlyDepth > 0 {
+		if err := retryCommand("Tags fetch", configs.RetryCount, configs.RetryWaitTime, func() error {
+			return doGitFetchTags(runner, cloneIntoDir, configs.TagsOnlyDepth, configs.ShowProgress)
+		}); err != nil {
+			return nil, fmt.Errorf("Could not fetch the tags, err: %s", err)
+		}
+	}
+
+	// e.g. the tag required for versioning, next to the shallow branch tip
+	if configs.AdditionalFetchRef != "" {
+		additionalFetchParams := FetchParamsModel{
+			CustomRefspec: configs.AdditionalFetchRef,
+			Depth:         configs.CloneDepth,
+			ShowProgress:  configs.ShowProgress,
+		}
+		if err := doGitFetch(runner, cloneIntoDir, additionalFetchParams); err != nil {
+			return nil, fmt.Errorf("Could not fetch additional ref (%s), err: %s", configs.AdditionalFetchRef, err)
+		}
+	}
+
+	// e.g. the base of a pull request opened from a fork, for merging upstream/<base> into it
+	if configs.UpstreamRepositoryURL != "" {
+		upstreamFetchParams := FetchParamsModel{
+			Remote:       "upstream",
+			Depth:        configs.CloneDepth,
+			ShowProgress: configs.ShowProgress,
+			Prune:        configs.FetchPrune,
+			NoTags:       configs.NoTags,
+		}
+		if err := retryCommand("Upstream fetch", configs.RetryCount, configs.RetryWaitTime, func() error {
+			return doGitFetch(runner, cloneIntoDir, upstreamFetchParams)
+		}); err != nil {
+			return nil, fmt.Errorf("Could not fetch from upstream repository, err: %s", err)
+		}
+	}
+
+	// a bare repository has no working tree, there is nothing to check out
+	if configs.Bare {
+		fetchedHeadHash, err := setBareRepositoryHead(runner, configs, gitCheckoutParam)
+		if err != nil {
+			return nil, err
+		}
+		commitStats = map[string]string{"GIT_CLONE_COMMIT_HASH": fetchedHeadHash}
+		for key, value := range phaseDurations {
+			commitStats[key] = value
+		}
+		exportOutput("GIT_CLONE_COMMIT_HASH", fetchedHeadHash)
+		return commitStats, nil
+	}
+
+	// e.g. HEAD~2 or main~5, checked out by the resolved hash
+	if configs.CustomFetchRefspec == "" && configs.PullRequestID == "" && isRelativeRevision(configs.Commit) {
+		resolvedCommit, err := resolveRelativeRevision(runner, cloneIntoDir, configs.Commit, configs.RemoteBranch)
+		if err != nil {
+			return nil, fmt.Errorf("Could not resolve the commit (%s), err: %s", configs.Commit, err)
+		}
+		fmt.Printf("Resolved %s to %s\n", configs.Commit, resolvedCommit)
+		gitCheckoutParam = resolvedCommit
+		checkoutRef = resolvedCommit
+	}
+
+	if gitCheckoutParam == "" {
+		defaultBranch, err := getRemoteDefaultBranch(runner, cloneIntoDir)
+		if err != nil {
+			fmt.Printf(" [!] Failed to detect the remote's default branch, err: %s\n", err)
+		} else if defaultBranch == "" {
+			fmt.Println(" [!] The remote reports no HEAD, can't detect its default branch")
+		} else {
+			fmt.Printf("Remote's default branch: %s\n", defaultBranch)
+			exportOutput("GIT_CLONE_DEFAULT_BRANCH", defaultBranch)
+
+			if configs.CheckoutDefaultBranch {
+				gitCheckoutParam = defaultBranch
+				checkoutRef = defaultBranch
+			}
+		}
+	}
+
+	// tags and branches are checked out by their full ref, as a branch and a tag can share the same name
+	isSelectedByName := configs.CustomFetchRefspec == "" && configs.PullRequestID == "" && configs.Commit == ""
+	isTagCheckout := isSelectedByName && configs.Tag != ""
+	remoteBranch := gitCheckoutParam
+	if configs.RemoteBranch != "" {
+		remoteBranch = configs.RemoteBranch
+	}
+	isBranchCheckout := isSelectedByName && configs.Tag == "" && gitCheckoutParam != "" &&
+		isGitRefExists(runner, cloneIntoDir, "refs/remotes/origin/"+remoteBranch)
+	checkout := func() error {
+		if isBranchCheckout {
+			// the local branch of a reused repository is updated to the fetched tip
+			return doGitCheckoutBranch(runner, cloneIntoDir, gitCheckoutParam, remoteBranch, configs.ForceCheckout, configs.ResetToRef || isReusedRepo)
+		}
+		if isTagCheckout {
+			return doGitCheckout(runner, cloneIntoDir, "refs/tags/"+gitCheckoutParam, configs.ForceCheckout)
+		}
+		return doGitCheckout(runner, cloneIntoDir, gitCheckoutParam, configs.ForceCheckout)
+	}
+
+	// a commit deeper in the history than clone_depth is not part of the shallow fetch
+	isShallowCommitCheckout := configs.CustomFetchRefspec == "" && configs.PullRequestID == "" && configs.Commit != "" && configs.CloneDepth != ""
+	if isShallowCommitCheckout {
+		shallowCheckout := checkout
+		checkout = func() error {
+			err := shallowCheckout()
+			if err == nil {
+				return nil
+			}
+			suggestion := fmt.Sprintf("the commit might be unreachable with clone_depth (%s), try removing clone_depth", configs.CloneDepth)
+			if shallowCommits, statErr := getShallowCommits(runner, cloneIntoDir); statErr != nil || shallowCommits == "" {
+				return fmt.Errorf("%s, %s", err, suggestion)
+			}
+
+			if configs.MaxDeepen > 0 {
+				return deepenUntilCheckout(runner, configs, shallowCheckout, err, suggestion)
+			}
 
-func genericIsPathExists(pth string) (os.FileInfo, bool, error) {
-	if pth == "" {
-		return nil, false, errors.New("No path provided")
-	}
-	fileInf, err := os.Stat(pth)
-	if err == nil {
-		return fileInf, true, nil
-	}
-	if os.IsNotExist(err) {
-		return nil, false, nil
+			fmt.Printf(" [!] Checkout of the commit (%s) failed, fetching the full history, err: %s\n", configs.Commit, err)
+			unshallowParams := FetchParamsModel{
+				Unshallow:    true,
+				ShowProgress: configs.ShowProgress,
+			}
+			if err := doGitFetch(runner, cloneIntoDir, unshallowParams); err != nil {
+				return fmt.Errorf("fetching the full history failed, err: %s, %s", err, suggestion)
+			}
+			if err := shallowCheckout(); err != nil {
+				return fmt.Errorf("%s, %s", err, suggestion)
+			}
+			return nil
+		}
 	}
-	return fileInf, false, err
-}
 
-func isPathExists(pth string) (bool, error) {
-	_, isExists, err := genericIsPathExists(pth)
-	return isExists, err
-}
+	if gitCheckoutParam != "" {
+		if configs.CleanBeforeCheckout != "" && configs.CleanBeforeCheckout != "none" {
+			if err := doGitClean(runner, cloneIntoDir, configs.CleanBeforeCheckout); err != nil {
+				return nil, fmt.Errorf("Could not clean the working tree, err: %s", err)
+			}
+		}
 
-func envmanAdd(key, value string) error {
-	args := []string{"add", "--key", key}
+		if len(configs.SparseCheckoutPaths) > 0 {
+			if err := doGitSparseCheckout(runner, cloneIntoDir, configs.SparseCheckoutPaths); err != nil {
+				return nil, fmt.Errorf("Could not set up sparse checkout, err: %s", err)
+			}
+		}
 
-	cmd := exec.Command("envman", args...)
-	cmd.Stdin = strings.NewReader(value)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+		checkoutStartTime := time.Now()
+		if err := checkout(); err != nil {
+			if isCorruptObjectError(err) {
+				return nil, corruptRepositoryError{err: fmt.Errorf("Could not do checkout (%s), the repository is corrupt, err: %s", gitCheckoutParam, err)}
+			}
+			if isCommitViaBranch {
+				return nil, fmt.Errorf("Could not do checkout (%s), the commit might not be reachable from the branch (%s), err: %s", gitCheckoutParam, configs.RemoteBranch, err)
+			}
+			if !isPullRequest || fetchParams.PullRequestRef == "head" {
+				return nil, fmt.Errorf("Could not do checkout (%s), err: %s", gitCheckoutParam, err)
+			}
 
-	return cmd.Run()
-}
+			// the merge ref might be removed by GitHub between the fetch and the checkout
+			fmt.Printf(" [!] Checkout of %s failed, falling back to the pull request's head ref, err: %s\n", checkoutRef, err)
+			fetchParams.PullRequestRef = "head"
+			if err := doGitFetchWithFallbacks(runner, cloneIntoDir, fetchParams); err != nil {
+				return nil, fmt.Errorf("Could not fetch the pull request's head ref, err: %s", err)
+			}
+			if err := checkout(); err != nil {
+				return nil, fmt.Errorf("Could not do checkout (%s), err: %s", gitCheckoutParam, err)
+			}
+			checkoutRef = "pull/" + configs.PullRequestID + "/head"
+		}
+		recordPhaseDuration("GIT_CLONE_CHECKOUT_DURATION_SECONDS", checkoutStartTime)
 
-func doGitInit(cloneIntoDir string) error {
-	cmd := exec.Command("git", "init")
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = cloneIntoDir
+		if isCommitViaBranch {
+			if err := verifyCommitOnBranch(runner, cloneIntoDir, configs.Commit, configs.RemoteBranch); err != nil {
+				return nil, err
+			}
+		}
 
-	return cmd.Run()
-}
+		if isPullRequest && configs.PullRequestHeadCommit != "" {
+			if err := checkoutPullRequestHeadCommit(runner, configs); err != nil {
+				return nil, err
+			}
+			checkoutRef = configs.PullRequestHeadCommit
+		}
 
-func doGitAddRemote(cloneIntoDir, repositoryURL string) error {
-	cmd := exec.Command("git", "remote", "add", "origin", repositoryURL)
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = cloneIntoDir
+		if configs.VerifyCommitSignature {
+			signatureStatus, err := verifyCommitSignature(runner, cloneIntoDir, configs.GPGPublicKeys)
+			exportOutput("GIT_CLONE_COMMIT_SIGNATURE_STATUS", signatureStatus)
+			if err != nil {
+				return nil, fmt.Errorf("Commit signature verification failed, err: %s", err)
+			}
+			fmt.Println("Commit signature verified")
+		}
 
-	return cmd.Run()
-}
+		// reproduces the missing merge ref's result
+		if isPullRequest && fetchParams.PullRequestRef == "head" && configs.MergeLocally {
+			if err := mergeBaseBranchLocally(runner, configs); err != nil {
+				return nil, err
+			}
+		}
 
-func doGitFetch(cloneIntoDir, pullRequestID, gitCheckoutParam string) error {
-	args := []string{"fetch"}
-	if pullRequestID != "" {
-		args = append(args, "origin", "pull/"+pullRequestID+"/merge:"+gitCheckoutParam)
-	}
+		// checks the connectivity and the validity of every object, not only the checked out ones
+		if configs.VerifyIntegrity {
+			fmt.Println("Verifying the repository's integrity")
+			fsckErr := runGitCommand(runner, cloneIntoDir, "fsck", "--full")
+			fsckStatus := "ok"
+			if fsckErr != nil {
+				fsckStatus = "failed"
+			}
+			exportOutput("GIT_CLONE_FSCK_STATUS", fsckStatus)
+			if fsckErr != nil {
+				return nil, corruptRepositoryError{err: fmt.Errorf("Repository integrity verification failed, err: %s", fsckErr)}
+			}
+		}
 
-	cmd := exec.Command("git", args...)
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = cloneIntoDir
+		if len(configs.SubmoduleIgnorePaths) > 0 {
+			if err := doGitSubmoduleIgnore(runner, cloneIntoDir, configs.SubmoduleIgnorePaths); err != nil {
+				return nil, fmt.Errorf("Could not ignore the submodules, err: %s", err)
+			}
+		}
 
-	return cmd.Run()
-}
+		// best effort: a failed status counts as no change
+		submoduleStatusBefore, _ := getSubmoduleStatus(runner, cloneIntoDir, configs.SubmoduleRecursive)
+		submoduleStartTime := time.Now()
+		if err := retryCommand("Submodule update", configs.RetryCount, configs.RetryWaitTime, func() error {
+			return doGitSubmodelueUpdate(runner, cloneIntoDir, !configs.SubmoduleSkipInit, configs.SubmoduleRecursive, configs.SubmoduleJobs, configs.SubmodulePaths)
+		}); err != nil {
+			return nil, fmt.Errorf("Could not fetch from submodule repositories (submodule update failed), err: %s", err)
+		}
+		recordPhaseDuration("GIT_CLONE_SUBMODULE_DURATION_SECONDS", submoduleStartTime)
 
-func doGitCheckout(cloneIntoDir, gitCheckoutParam string) error {
-	cmd := exec.Command("git", "checkout", gitCheckoutParam)
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = cloneIntoDir
+		submoduleStatusAfter, _ := getSubmoduleStatus(runner, cloneIntoDir, configs.SubmoduleRecursive)
+		isSubmodulesUpdated := submoduleStatusBefore != submoduleStatusAfter
+		exportOutput("GIT_CLONE_SUBMODULES_UPDATED", fmt.Sprintf("%t", isSubmodulesUpdated))
 
-	return cmd.Run()
-}
+		submodules, err := getSubmodules(runner, cloneIntoDir, configs.SubmoduleRecursive)
+		if err != nil {
+			fmt.Println(err)
+		}
+		exportOutput("GIT_CLONE_SUBMODULES", strings.Join(submodules, "\n"))
 
-func doGitSubmodelueUpdate(cloneIntoDir string) error {
-	cmd := exec.Command("git", "submodule", "update", "--init", "--recursive")
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Dir = cloneIntoDir
+		if configs.PostCheckoutCommand != "" {
+			fmt.Printf("$ %s\n", configs.PostCheckoutCommand)
+			exitCode, output, err := runPostCheckoutCommand(runner, cloneIntoDir, configs.PostCheckoutCommand)
+			exportOutput("GIT_CLONE_POST_CHECKOUT_COMMAND_EXIT_CODE", fmt.Sprintf("%d", exitCode))
+			if err != nil {
+				return nil, fmt.Errorf("Post checkout command failed (exit code: %d, output length: %d), err: %s", exitCode, len(output), err)
+			}
+		}
+	} else {
+		if configs.RequireCheckout {
+			return nil, errors.New("No checkout parameter (branch, tag, commit hash or pull-request ID) provided, but require_checkout is set")
+		}
+		fmt.Println(" [!] No checkout parameter (branch, tag, commit hash or pull-request ID) provided!")
+	}
 
-	return cmd.Run()
-}
+	// git clone stats
+	//  collected whenever there is a valid HEAD, even if the checkout was skipped
+	if isGitRefExists(runner, cloneIntoDir, "HEAD") {
+		commitStats = getCommitStats(runner, cloneIntoDir, configs.CommitLogFormat, configs.ChangedFilesAgainst)
+		if gitCheckoutParam != "" {
+			commitStats["GIT_CLONE_CHECKOUT_REF"] = checkoutRef
+		}
+		// empty if the checkout was not driven by the tag input (e.g. a commit on a tag)
+		commitStats["GIT_CLONE_TAG"] = ""
+		if isTagCheckout {
+			commitStats["GIT_CLONE_TAG"] = configs.Tag
+		}
+		// e.g. for a base vs head diff in the later steps
+		if configs.PullRequestID != "" {
+			commitStats["GIT_CLONE_PULL_REQUEST_ID"] = configs.PullRequestID
+			if configs.BaseBranch != "" {
+				commitStats["GIT_CLONE_PULL_REQUEST_BASE_BRANCH"] = configs.BaseBranch
+			}
+		}
 
-func getGitLog(cloneIntoDir, formatParam string) (string, error) {
-	outBuffer := bytes.Buffer{}
-	errBuffer := bytes.Buffer{}
+		repoRoot, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "--show-toplevel")
+		if err != nil {
+			return nil, fmt.Errorf("The checkout did not produce a git repository, err: %s", err)
+		}
+		commitStats["GIT_CLONE_REPO_ROOT"] = strings.TrimSpace(repoRoot)
 
-	cmd := exec.Command("git", "log", "-1", "--format="+formatParam)
-	cmd.Stdin = nil
-	cmd.Stdout = io.Writer(&outBuffer)
-	cmd.Stderr = io.Writer(&errBuffer)
-	cmd.Dir = cloneIntoDir
+		// written as git prints it, without any re-encoding, an env var might be truncated by the shell
+		if configs.CommitMessageFile != "" {
+			commitMessage, err := getGitLog(runner, cloneIntoDir, "%B")
+			if err != nil {
+				return nil, fmt.Errorf("Could not get the commit message, err: %s", err)
+			}
+			if err := writeStringToFileWithPermission(configs.CommitMessageFile, commitMessage, 0644); err != nil {
+				return nil, fmt.Errorf("Could not write the commit message into %s, err: %s", configs.CommitMessageFile, err)
+			}
+			commitStats["GIT_CLONE_COMMIT_MESSAGE_FILE"] = configs.CommitMessageFile
+		}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("git log failed, err: %s, details: %s", err, errBuffer.String())
-	}
-	return outBuffer.String(), nil
+		// created from the commit (not from the working tree), before the .git folder is removed
+		if configs.ExportTarballPath != "" {
+			fmt.Printf("Exporting the source into %s\n", configs.ExportTarballPath)
+			if err := runGitCommand(runner, cloneIntoDir, "archive", "--format=tar.gz", "-o", configs.ExportTarballPath, "HEAD"); err != nil {
+				return nil, fmt.Errorf("Could not export the source tarball, err: %s", err)
+			}
+			commitStats["GIT_CLONE_TARBALL_PATH"] = configs.ExportTarballPath
+		}
 
-}
+		// a cache key which only depends on the content, not on the commit's metadata
+		if configs.ComputeTreeHash {
+			treeHash, err := getGitOutput(runner, cloneIntoDir, "rev-parse", "HEAD^{tree}")
+			if err != nil {
+				fmt.Println(err)
+			}
+			commitStats["GIT_CLONE_TREE_HASH"] = strings.TrimSpace(treeHash)
+			commitStats["GIT_CLONE_WORKING_TREE_SIZE_BYTES"] = fmt.Sprintf("%d", dirSize(cloneIntoDir)-dirSize(gitCheckPath))
+		}
 
-func doGitClone(cloneIntoDir, repositoryURL, pullRequestID, gitCheckoutParam string) error {
-	gitCheckPath := path.Join(cloneIntoDir, ".git")
-	if exist, err := isPathExists(gitCheckPath); err != nil {
-		return fmt.Errorf("Failed to file path (%s), err: %s", gitCheckPath, err)
-	} else if exist {
-		return fmt.Errorf(".git folder already exists in the destination dir (%s)", gitCheckPath)
+		for key, value := range commitStats {
+			exportOutput(key, value)
+		}
 	}
 
-	if err := os.MkdirAll(cloneIntoDir, 0777); err != nil {
-		return fmt.Errorf("Failed to create the clone_destination_dir at: %s", cloneIntoDir)
+	// the commit stats are already collected, the history is not required anymore
+	if gitCheckoutParam != "" && configs.RemoveGitDir {
+		// with separate_git_dir the .git file only points to the history
+		if configs.SeparateGitDir != "" {
+			gitDir, err := getGitDir(runner, cloneIntoDir)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get the git dir, err: %s", err)
+			}
+			if isDangerousPathToRemove(gitDir) {
+				return nil, fmt.Errorf("refusing to remove %s", gitDir)
+			}
+			fmt.Printf("Removing the separate git dir (%s)\n", gitDir)
+			if err := os.RemoveAll(gitDir); err != nil {
+				return nil, fmt.Errorf("Failed to remove the separate git dir (%s), err: %s", gitDir, err)
+			}
+		}
+		// the submodules' .git files would point to the removed git dir
+		fmt.Printf("Removing the .git folder (%s) and the submodules' .git files\n", gitCheckPath)
+		if err := removeGitEntries(cloneIntoDir); err != nil {
+			return nil, fmt.Errorf("Failed to remove the .git folder (%s), err: %s", gitCheckPath, err)
+		}
 	}
 
-	if err := doGitInit(cloneIntoDir); err != nil {
-		return fmt.Errorf("Could not init git repository, err: %s", cloneIntoDir)
+	if commitStats == nil {
+		commitStats = map[string]string{}
 	}
-
-	if err := doGitAddRemote(cloneIntoDir, repositoryURL); err != nil {
-		return fmt.Errorf("Could not add remote, err: %s", err)
+	for key, value := range phaseDurations {
+		commitStats[key] = value
 	}
 
-	if err := doGitFetch(cloneIntoDir, pullRequestID, gitCheckoutParam); err != nil {
-		return fmt.Errorf("Could not fetch from repository, err: %s", err)
-	}
+	return commitStats, nil
+}
 
-	if gitCheckoutParam != "" {
-		if err := doGitCheckout(cloneIntoDir, gitCheckoutParam); err != nil {
-			return fmt.Errorf("Could not do checkout (%s), err: %s", gitCheckoutParam, err)
+// -----------------------
+// --- main
+// -----------------------
+
+func main() {
+	runner := ExecCommandRunner{}
+	configs := createConfigsModelFromEnvs()
+	isExportOutputs = configs.ExportOutputs
+
+	// e.g. FRONTEND_ for FRONTEND_GIT_CLONE_COMMIT_HASH
+	if configs.OutputPrefix != "" {
+		if !isEnvVarName(configs.OutputPrefix) {
+			log.Fatalf("Input validation failed, err: [!] Invalid output_prefix: %s (only letters, digits and _ are allowed, and it can't start with a digit)", configs.OutputPrefix)
 		}
+		outputPrefix = configs.OutputPrefix
+	}
 
-		if err := doGitSubmodelueUpdate(cloneIntoDir); err != nil {
-			return fmt.Errorf("Could not fetch from submodule repositories, err: %s", err)
+	if configs.OutputFile != "" && configs.ExportOutputs {
+		// outputs of a previous run are not kept
+		if err := writeStringToFileWithPermission(configs.OutputFile, "", 0644); err != nil {
+			log.Fatalf("Input validation failed, err: [!] Invalid output_file: %s", err)
 		}
+		outputFilePath = configs.OutputFile
+	}
 
-		// git clone stats
-		commitStats := map[string]string{}
-		commitHashStr, err := getGitLog(cloneIntoDir, "%H")
-		if err != nil {
-			fmt.Println(err)
+	if configs.GitBinary != "" {
+		if err := validateExecutable(configs.GitBinary); err != nil {
+			log.Fatalf("Input validation failed, err: [!] Invalid git_binary: %s", err)
 		}
-		commitStats["GIT_CLONE_COMMIT_HASH"] = commitHashStr
+		gitBinary = configs.GitBinary
+	} else if _, err := exec.LookPath("git"); err != nil {
+		log.Fatalf("git executable not found in PATH, err: %s", err)
+	}
+
+	//
+	// Required parameters
+	if err := validateRequiredInput("repository_url", configs.RepositoryURL); err != nil {
+		log.Fatalf("Input validation failed, err: %s", err)
+	}
+	if err := validateRequiredInput("clone_into_dir", configs.CloneIntoDir); err != nil {
+		log.Fatalf("Input validation failed, err: %s", err)
+	}
+
+	// Normalize input pathes
+	absCloneIntoDir, err := filepath.Abs(configs.CloneIntoDir)
+	if err != nil {
+		log.Fatalf("Failed to expand path (%s), err: %s", configs.CloneIntoDir, err)
+	}
+	configs.CloneIntoDir = absCloneIntoDir
 
-		commitMsgSubjectStr, err := getGitLog(cloneIntoDir, "%s")
+	if configs.SeparateGitDir != "" {
+		if configs.Bare {
+			log.Fatalf("Input validation failed, err: [!] bare and separate_git_dir can't be used together")
+		}
+		absSeparateGitDir, err := filepath.Abs(configs.SeparateGitDir)
 		if err != nil {
-			fmt.Println(err)
+			log.Fatalf("Failed to expand path (%s), err: %s", configs.SeparateGitDir, err)
 		}
-		commitStats["GIT_CLONE_COMMIT_MESSAGE_SUBJECT"] = commitMsgSubjectStr
+		configs.SeparateGitDir = absSeparateGitDir
+	}
 
-		commitMsgBodyStr, err := getGitLog(cloneIntoDir, "%b")
+	if configs.ExportTarballPath != "" {
+		absExportTarballPath, err := filepath.Abs(configs.ExportTarballPath)
 		if err != nil {
-			fmt.Println(err)
+			log.Fatalf("Failed to expand path (%s), err: %s", configs.ExportTarballPath, err)
 		}
-		commitStats["GIT_CLONE_COMMIT_MESSAGE_BODY"] = commitMsgBodyStr
+		configs.ExportTarballPath = absExportTarballPath
+	}
 
-		commitAuthorNameStr, err := getGitLog(cloneIntoDir, "%an")
+	if configs.CommitMessageFile != "" {
+		absCommitMessageFile, err := filepath.Abs(configs.CommitMessageFile)
 		if err != nil {
-			fmt.Println(err)
+			log.Fatalf("Failed to expand path (%s), err: %s", configs.CommitMessageFile, err)
 		}
-		commitStats["GIT_CLONE_COMMIT_AUTHOR_NAME"] = commitAuthorNameStr
+		configs.CommitMessageFile = absCommitMessageFile
+	}
 
-		commitAuthorEmailStr, err := getGitLog(cloneIntoDir, "%ae")
-		if err != nil {
-			fmt.Println(err)
+	if configs.AllowedRoot != "" {
+		if err := validatePathInsideRoot(configs.CloneIntoDir, configs.AllowedRoot); err != nil {
+			log.Fatalf("Input validation failed, err: [!] Invalid clone_into_dir: %s", err)
 		}
-		commitStats["GIT_CLONE_COMMIT_AUTHOR_EMAIL"] = commitAuthorEmailStr
+	}
 
-		commitCommiterNameStr, err := getGitLog(cloneIntoDir, "%cn")
+	preparedRepoURL, err := prepareRepositoryURL(configs.RepositoryURL)
+	if err != nil {
+		log.Fatalf("Input validation failed, err: [!] Invalid repository_url: %s", err)
+	}
+	configs.RepositoryURL = preparedRepoURL
+
+	if configs.MirrorToURL != "" {
+		preparedMirrorURL, err := prepareRepositoryURL(configs.MirrorToURL)
 		if err != nil {
-			fmt.Println(err)
+			log.Fatalf("Input validation failed, err: [!] Invalid mirror_to_url: %s", err)
 		}
-		commitStats["GIT_CLONE_COMMIT_COMMITER_NAME"] = commitCommiterNameStr
+		configs.MirrorToURL = preparedMirrorURL
+	}
+	if (configs.MirrorAuthUser != "" || configs.MirrorAuthPassword != "") && !isHTTPURL(configs.MirrorToURL) {
+		log.Fatalf("Input validation failed, err: [!] mirror_auth_user / mirror_auth_password can only be used with an http(s) mirror_to_url, an ssh mirror is authenticated with the ssh keys")
+	}
 
-		commitCommiterEmailStr, err := getGitLog(cloneIntoDir, "%ce")
+	if configs.UpstreamRepositoryURL != "" {
+		preparedUpstreamURL, err := prepareRepositoryURL(configs.UpstreamRepositoryURL)
 		if err != nil {
-			fmt.Println(err)
+			log.Fatalf("Input validation failed, err: [!] Invalid upstream_repository_url: %s", err)
 		}
-		commitStats["GIT_CLONE_COMMIT_COMMITER_EMAIL"] = commitCommiterEmailStr
+		configs.UpstreamRepositoryURL = preparedUpstreamURL
+	}
 
-		for key, value := range commitStats {
-			if err := envmanAdd(key, value); err != nil {
-				fmt.Printf("Faild to export ouput: (%s), err: %s\n", key, err)
+	if len(configs.AllowedHosts) > 0 {
+		if err := validateAllowedHost(configs.RepositoryURL, configs.AllowedHosts); err != nil {
+			log.Fatalf("Input validation failed, err: [!] Invalid repository_url: %s", err)
+		}
+		if configs.UpstreamRepositoryURL != "" {
+			if err := validateAllowedHost(configs.UpstreamRepositoryURL, configs.AllowedHosts); err != nil {
+				log.Fatalf("Input validation failed, err: [!] Invalid upstream_repository_url: %s", err)
 			}
 		}
-	} else {
-		fmt.Println(" [!] No checkout parameter (branch, tag, commit hash or pull-request ID) provided!")
 	}
 
-	return nil
-}
-
-// -----------------------
-// --- main
-// -----------------------
+	gitConfigs, err := parseKeyValueList(getListInput("git_config"))
+	if err != nil {
+		log.Fatalf("Input validation failed, err: [!] Invalid git_config: %s", err)
+	}
+	configs.GitConfigs = gitConfigs
 
-func main() {
-	//
-	// Required parameters
-	repoURL, err := validateRequiredInput("repository_url")
+	// set for the whole step, so the step's own variables (GIT_SSH, GIT_ASKPASS, GIT_TERMINAL_PROMPT) set later take precedence
+	gitEnvs, err := parseKeyValueList(getListInput("git_env"))
 	if err != nil {
-		log.Fatalf("Input validation failed, err: %s", err)
+		log.Fatalf("Input validation failed, err: [!] Invalid git_env: %s", err)
 	}
-	cloneIntoDir, err := validateRequiredInput("clone_into_dir")
+	if err := setGitEnvs(gitEnvs); err != nil {
+		log.Fatalf("Failed to set git_env, err: %s", err)
+	}
+
+	retryCount, err := getNonNegativeIntInput("retry_count", 2)
 	if err != nil {
-		log.Fatalf("Input validation failed, err: %s", err)
+		log.Fatalf("Input validation failed, err: [!] %s", err)
 	}
+	configs.RetryCount = retryCount
 
-	//
-	// Optional parameters
-	commit := os.Getenv("commit")
-	tag := os.Getenv("tag")
-	branch := os.Getenv("branch")
-	pullRequestID := os.Getenv("pull_request_id")
+	retryWaitTimeSeconds, err := getNonNegativeIntInput("retry_wait_time", 5)
+	if err != nil {
+		log.Fatalf("Input validation failed, err: [!] %s", err)
+	}
+	configs.RetryWaitTime = time.Duration(retryWaitTimeSeconds) * time.Second
 
-	// Normalize input pathes
-	absCloneIntoDir, err := filepath.Abs(cloneIntoDir)
+	maxFetchBytes, err := getNonNegativeIntInput("max_fetch_bytes", 0)
 	if err != nil {
-		log.Fatalf("Failed to expand path (%s), err: %s", cloneIntoDir, err)
+		log.Fatalf("Input validation failed, err: [!] %s", err)
 	}
+	configs.MaxFetchBytes = maxFetchBytes
 
-	// Parse repo uri
-	preparedRepoURL, err := url.Parse(repoURL)
+	maxDeepen, err := getNonNegativeIntInput("max_deepen", 0)
 	if err != nil {
-		log.Fatalf("Failed to parse repo url (%s), err: %s", repoURL, err)
+		log.Fatalf("Input validation failed, err: [!] %s", err)
+	}
+	configs.MaxDeepen = maxDeepen
+
+	if submoduleJobs := getInput("submodule_jobs"); submoduleJobs != "" {
+		jobs, err := strconv.Atoi(submoduleJobs)
+		if err != nil || jobs < 1 {
+			log.Fatalf("Input validation failed, err: [!] Invalid submodule_jobs: %s (should be a positive integer)", submoduleJobs)
+		}
+		configs.SubmoduleJobs = jobs
+	}
+
+	if tagsOnlyDepth := getInput("tags_only_depth"); tagsOnlyDepth != "" {
+		depth, err := strconv.Atoi(tagsOnlyDepth)
+		if err != nil || depth < 1 {
+			log.Fatalf("Input validation failed, err: [!] Invalid tags_only_depth: %s (should be a positive integer)", tagsOnlyDepth)
+		}
+		configs.TagsOnlyDepth = depth
+	}
+
+	if err := validateFetchOptions(configs); err != nil {
+		log.Fatalf("Input validation failed, err: [!] %s", err)
+	}
+
+	if configs.CloneDepth != "" && configs.Commit != "" && configs.PullRequestID == "" && configs.CustomFetchRefspec == "" {
+		fallback := "the full history is fetched"
+		if configs.MaxDeepen > 0 {
+			fallback = fmt.Sprintf("the history is deepened by at most max_deepen (%d) commits", configs.MaxDeepen)
+		}
+		fmt.Printf(" [!] clone_depth (%s) is used with a commit (%s), the commit might be unreachable in the shallow history, %s if the checkout fails\n", configs.CloneDepth, configs.Commit, fallback)
+	}
+
+	// e.g. develop checked out as integration: integration:develop
+	if configs.Branch != "" {
+		configs.Branch, configs.RemoteBranch, err = parseBranchMapping(configs.Branch)
+		if err != nil {
+			log.Fatalf("Input validation failed, err: %s", err)
+		}
 	}
 
 	// do clone
 	gitCheckoutParam := ""
-	if len(pullRequestID) > 0 {
-		gitCheckoutParam = "pull/" + pullRequestID
-	} else if len(commit) > 0 {
-		gitCheckoutParam = commit
-	} else if len(tag) > 0 {
+	if len(configs.CustomCheckoutRef) > 0 {
+		// custom refspec / ref (e.g. gerrit's refs/changes/...) bypasses the other checkout parameters
+		gitCheckoutParam = configs.CustomCheckoutRef
+	} else if len(configs.PullRequestID) > 0 {
+		gitCheckoutParam = "pull/" + configs.PullRequestID
+	} else if len(configs.Commit) > 0 {
+		gitCheckoutParam = configs.Commit
+	} else if len(configs.Tag) > 0 {
 		// since git 1.8.x tags can be specified as "branch" too ( http://git-scm.com/docs/git-clone )
 		//  [!] this will create a detached head, won't switch to a branch!
-		gitCheckoutParam = tag
-	} else if len(branch) > 0 {
-		gitCheckoutParam = branch
+		gitCheckoutParam = configs.Tag
+	} else if len(configs.Branch) > 0 {
+		gitCheckoutParam = configs.Branch
 	} else {
 		fmt.Println(" [!] No checkout parameter found")
 	}
 
-	if err := doGitClone(absCloneIntoDir, preparedRepoURL.String(), pullRequestID, gitCheckoutParam); err != nil {
+	if configs.OutputFormat != "" && configs.OutputFormat != "text" && configs.OutputFormat != "json" {
+		log.Fatalf("Input validation failed, err: [!] Invalid output_format: %s (valid options: text, json)", configs.OutputFormat)
+	}
+
+	if configs.CleanBeforeCheckout != "" && configs.CleanBeforeCheckout != "none" && configs.CleanBeforeCheckout != "clean" && configs.CleanBeforeCheckout != "clean-xdff" {
+		log.Fatalf("Input validation failed, err: [!] Invalid clean_before_checkout: %s (valid options: none, clean, clean-xdff)", configs.CleanBeforeCheckout)
+	}
+
+	if configs.ExistingGitDir != "" && configs.ExistingGitDir != "fail" && configs.ExistingGitDir != "fetch" && configs.ExistingGitDir != "replace" {
+		log.Fatalf("Input validation failed, err: [!] Invalid existing_git_dir_strategy: %s (valid options: fail, fetch, replace)", configs.ExistingGitDir)
+	}
+
+	if configs.AutoCRLF != "" && configs.AutoCRLF != "input" && configs.AutoCRLF != "false" && configs.AutoCRLF != "true" {
+		log.Fatalf("Input validation failed, err: [!] Invalid autocrlf: %s (valid options: input, false, true)", configs.AutoCRLF)
+	}
+
+	if configs.CustomCheckoutRef == "" {
+		if err := validateCheckoutSelectors(configs, gitCheckoutParam); err != nil {
+			log.Fatalf("Input validation failed, err: %s", err)
+		}
+	}
+
+	if configs.PullRequestHeadCommit != "" && configs.PullRequestID == "" {
+		fmt.Println(" [!] pull_request_head_commit is provided without pull_request_id, it won't be used")
+	}
+	if configs.MergeLocally && configs.PullRequestID != "" && configs.BaseBranch == "" {
+		log.Fatalf("Input validation failed, err: [!] merge_locally requires base_branch")
+	}
+
+	gitMajor, gitMinor, gitPatch, err := gitVersion(runner)
+	if err != nil {
+		fmt.Printf(" [!] Failed to detect the git version, err: %s\n", err)
+		configs.EnableProtocolV2 = false
+	} else {
+		fmt.Printf("git version: %d.%d.%d\n", gitMajor, gitMinor, gitPatch)
+		if err := checkGitVersion(requiredGitFeatures(configs), gitMajor, gitMinor); err != nil {
+			log.Fatalf("Input validation failed, err: [!] %s", err)
+		}
+
+		// older gits ignore the config, but it's not set to keep the repository's config clean
+		if configs.EnableProtocolV2 && checkGitVersion([]GitFeatureModel{{Name: "enable_protocol_v2", MinimumMajor: 2, MinimumMinor: 18}}, gitMajor, gitMinor) != nil {
+			configs.EnableProtocolV2 = false
+		}
+
+		// the submodules are still updated without --jobs, just serially
+		if configs.SubmoduleJobs > 0 {
+			submoduleJobsFeature := GitFeatureModel{Name: "submodule_jobs", MinimumMajor: 2, MinimumMinor: 9}
+			if err := checkGitVersion([]GitFeatureModel{submoduleJobsFeature}, gitMajor, gitMinor); err != nil {
+				fmt.Printf(" [!] %s, the submodules are updated one by one\n", err)
+				configs.SubmoduleJobs = 0
+			}
+		}
+	}
+
+	additionalSSHKeyEnvs, err := parseKeyValueList(getListInput("additional_ssh_private_keys"))
+	if err != nil {
+		log.Fatalf("Input validation failed, err: [!] Invalid additional_ssh_private_keys: %s", err)
+	}
+	for _, hostKeyEnv := range additionalSSHKeyEnvs {
+		privateKey := os.Getenv(strings.TrimSpace(hostKeyEnv.Value))
+		if privateKey == "" {
+			log.Fatalf("Input validation failed, err: [!] Invalid additional_ssh_private_keys: the environment variable (%s) of host (%s) is empty", hostKeyEnv.Value, hostKeyEnv.Key)
+		}
+		configs.AdditionalSSHPrivateKeys = append(configs.AdditionalSSHPrivateKeys, KeyValueModel{Key: hostKeyEnv.Key, Value: privateKey})
+	}
+
+	if configs.SSHPort != "" {
+		if port, err := strconv.Atoi(configs.SSHPort); err != nil || port < 1 || port > 65535 {
+			log.Fatalf("Input validation failed, err: [!] Invalid ssh_port: %s (should be between 1 and 65535)", configs.SSHPort)
+		}
+		if urlPort := getSSHURLPort(configs.RepositoryURL); urlPort != "" && urlPort != configs.SSHPort {
+			fmt.Printf(" [!] The repository_url's port (%s) is overridden by ssh_port (%s)\n", urlPort, configs.SSHPort)
+		}
+	}
+
+	if configs.UseTempSSHDir && configs.SSHDir != "" {
+		fmt.Println(" [!] use_temp_ssh_dir is set, ssh_dir won't be used")
+	}
+
+	gitGlobalArgs = getGitGlobalArgs(configs)
+
+	if err := setupTerminalPrompt(configs.AllowTerminalPrompt); err != nil {
+		log.Fatalf("Failed to set GIT_TERMINAL_PROMPT, err: %s", err)
+	}
+
+	authMethod, authWarnings := selectAuthMethod(configs.RepositoryURL, configs.AuthSSHPrivateKey, configs.AuthUser, configs.AuthPassword)
+	for _, warning := range authWarnings {
+		fmt.Printf(" [!] %s\n", warning)
+	}
+
+	// additional (per host) ssh keys are used for the submodules, regardless of the main repository's url
+	sshPrivateKey := ""
+	if authMethod == AuthMethodSSHKey {
+		sshPrivateKey = configs.AuthSSHPrivateKey
+	}
+	cleanupSSHAuth := func() {}
+	if sshPrivateKey != "" || len(configs.AdditionalSSHPrivateKeys) > 0 || len(configs.SSHOptions) > 0 || configs.SSHProxyJump != "" || configs.SSHPort != "" {
+		cleanupSSHAuth, err = setupSSHAuth(configs, sshPrivateKey)
+		if err != nil {
+			cleanupSSHAuth()
+			log.Fatalf("Failed to set up SSH authentication, err: %s", err)
+		}
+	}
+
+	if authMethod == AuthMethodHTTPS && configs.DisableAskpassOverride {
+		fmt.Println(" [!] disable_askpass_override is set, auth_user / auth_password won't be used, the configured credential helper has to authenticate")
+		authMethod = AuthMethodNone
+	}
+
+	cleanupHTTPSAuth := func() {}
+	if authMethod == AuthMethodHTTPS {
+		cleanupHTTPSAuth, err = setupHTTPSAuth(configs.AuthUser, configs.AuthPassword)
+		if err != nil {
+			cleanupSSHAuth()
+			cleanupHTTPSAuth()
+			log.Fatalf("Failed to set up HTTPS authentication, err: %s", err)
+		}
+	}
+
+	startTime := time.Now()
+	commitStats, err := doGitCloneWithRecovery(runner, configs, gitCheckoutParam)
+	cloneDuration := time.Since(startTime)
+	// still with the clone's auth, a different auth (if any) is set up only for the push
+	var mirrorErr error
+	if err == nil && configs.MirrorToURL != "" {
+		mirrorErr = doGitMirrorPush(runner, configs)
+	}
+	cleanupSSHAuth()
+	cleanupHTTPSAuth()
+	if err != nil {
 		log.Fatalf("git clone failed, err: %s", err)
 	}
+	if mirrorErr != nil {
+		log.Fatalf("git mirror push failed, err: %s", mirrorErr)
+	}
+
+	fmt.Printf("Clone finished in %s\n", cloneDuration.Round(time.Millisecond))
+	exportOutput("GIT_CLONE_DURATION_SECONDS", fmt.Sprintf("%.2f", cloneDuration.Seconds()))
+
+	if configs.OutputFormat == "json" {
+		if err := printCloneResultJSON(configs, commitStats, cloneDuration); err != nil {
+			log.Fatalf("Failed to print clone result, err: %s", err)
+		}
+	}
 }
@@ -11,4 +11,4 @@ if [ ! -z "${workdir}" ] ; then
 	cd "${workdir}"
 fi
 
-go run ${THIS_SCRIPTDIR}/step.go
+go run ${THIS_SCRIPTDIR}/step.go ${THIS_SCRIPTDIR}/util.go
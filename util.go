@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CommandRunner runs an external command in the given dir, with env added to the step's environment,
+// writing the command's output to stdout and stderr.
+type CommandRunner interface {
+	Run(ctx context.Context, dir string, env []string, stdout, stderr io.Writer, name string, args ...string) error
+}
+
+// ExecCommandRunner is the default CommandRunner, which runs the commands with os/exec.
+type ExecCommandRunner struct{}
+
+// Run ...
+func (runner ExecCommandRunner) Run(ctx context.Context, dir string, env []string, stdout, stderr io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = nil
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Dir = dir
+	if len(env) > 0 {
+		// the later value wins for a duplicated key
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	return cmd.Run()
+}
+
+func genericIsPathExists(pth string) (os.FileInfo, bool, error) {
+	if pth == "" {
+		return nil, false, errors.New("No path provided")
+	}
+	fileInf, err := os.Stat(pth)
+	if err == nil {
+		return fileInf, true, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return fileInf, false, err
+}
+
+func isPathExists(pth string) (bool, error) {
+	_, isExists, err := genericIsPathExists(pth)
+	return isExists, err
+}
+
+// writeBytesToFileWithPermission writes into a temp file next to pth, then renames it to pth,
+// so a crash mid-write never leaves a partially written file (e.g. a truncated key) behind.
+func writeBytesToFileWithPermission(pth string, fileCont []byte, perm os.FileMode) error {
+	if pth == "" {
+		return errors.New("No path provided")
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(pth), "."+filepath.Base(pth)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPth := tmpFile.Name()
+	isRenamed := false
+	defer func() {
+		if isRenamed {
+			return
+		}
+		if err := os.Remove(tmpPth); err != nil && !os.IsNotExist(err) {
+			fmt.Printf(" [!] Failed to remove temp file (%s), err: %s\n", tmpPth, err)
+		}
+	}()
+
+	if _, err := tmpFile.Write(fileCont); err != nil {
+		if closeErr := tmpFile.Close(); closeErr != nil {
+			fmt.Printf(" [!] Failed to close file (%s), err: %s\n", tmpPth, closeErr)
+		}
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	// the temp file is created with 0600
+	if err := os.Chmod(tmpPth, perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPth, pth); err != nil {
+		return err
+	}
+	isRenamed = true
+	return nil
+}
+
+func writeStringToFileWithPermission(pth, fileCont string, perm os.FileMode) error {
+	return writeBytesToFileWithPermission(pth, []byte(fileCont), perm)
+}
+
+// sanitizeFileName replaces every character which is not safe in a file name with _
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// wraps the value in single quotes, so it can be used as a single shell word
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", "'\\''", -1) + "'"
+}
+
+// isDangerousPathToRemove reports whether the path is the root or the home directory
+func isDangerousPathToRemove(pth string) bool {
+	cleanPth := filepath.Clean(pth)
+	if cleanPth == string(filepath.Separator) {
+		return true
+	}
+	// the same home directory as the ssh dir's, even if HOME is not set
+	if home, err := homeDir(); err == nil && cleanPth == filepath.Clean(home) {
+		return true
+	}
+	return false
+}
+
+// dirSize returns the total size of the files in the directory,
+// files removed during the walk (e.g. git's temp files) are skipped
+func dirSize(dir string) int64 {
+	size := int64(0)
+	if err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	}); err != nil {
+		fmt.Printf(" [!] Failed to walk dir (%s), err: %s\n", dir, err)
+	}
+	return size
+}
+
+// cleanDir removes the content of the directory, but keeps the directory itself
+func cleanDir(dir string) error {
+	if isDangerousPathToRemove(dir) {
+		return fmt.Errorf("refusing to remove the content of %s", dir)
+	}
+
+	if exist, err := isPathExists(dir); err != nil {
+		return err
+	} else if !exist {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removing the content of %s\n", dir)
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeGitEntries removes every .git file and directory in the tree of dir,
+// e.g. the submodules' .git files next to the repository's .git folder
+func removeGitEntries(dir string) error {
+	return filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() != ".git" {
+			return nil
+		}
+		if err := os.RemoveAll(pth); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}